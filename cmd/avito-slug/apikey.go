@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/lib/secret"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/storage"
+	"avito-test-task-2023/internal/storage/postgres"
+)
+
+const apiKeyUsage = "usage: avito-slug apikey create <name> reader|analyst|admin"
+
+// runAPIKey implements the "apikey" subcommand, which is used to create the first admin key:
+//
+//	avito-slug apikey create <name> <role> create an API key and print its secret
+func runAPIKey(ctx context.Context, cfg config.Storage, args []string) error {
+	if len(args) != 3 || args[0] != "create" {
+		return errors.New(apiKeyUsage)
+	}
+
+	name, role := args[1], args[2]
+	if !apikey.ValidRole(role) {
+		return fmt.Errorf("invalid role %q: %s", role, apiKeyUsage)
+	}
+
+	if cfg.Type != storagePostgres {
+		return fmt.Errorf("api keys can be created by %q storage only, got %q", storagePostgres, cfg.Type)
+	}
+
+	s, err := postgres.New(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	key, err := secret.GenerateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := s.SaveAPIKey(ctx, name, role, secret.Hash(key))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created api key %d (%s, %s)\n%s\n", apiKey.ID, apiKey.Name, apiKey.Role, key)
+
+	return nil
+}
+
+// bootstrapAPIKey stores the key as an admin API key unless it is stored already.
+func bootstrapAPIKey(ctx context.Context, s storage.Storage, key string) error {
+	hash := secret.Hash(key)
+
+	_, err := s.GetAPIKeyByHash(ctx, hash)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrAPIKeyNotFound) {
+		return err
+	}
+
+	_, err = s.SaveAPIKey(ctx, "bootstrap", apikey.RoleAdmin, hash)
+	return err
+}
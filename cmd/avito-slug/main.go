@@ -1,24 +1,53 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 
+	slugv1 "avito-test-task-2023/api/slug/v1"
 	_ "avito-test-task-2023/docs"
 	"avito-test-task-2023/internal/config"
+	grpcInterceptors "avito-test-task-2023/internal/grpc-server/interceptors"
+	"avito-test-task-2023/internal/grpc-server/services"
+	"avito-test-task-2023/internal/http-server/handlers/apikeys"
+	"avito-test-task-2023/internal/http-server/handlers/experiments"
+	"avito-test-task-2023/internal/http-server/handlers/health"
+	"avito-test-task-2023/internal/http-server/handlers/jobs"
 	"avito-test-task-2023/internal/http-server/handlers/segments"
 	"avito-test-task-2023/internal/http-server/handlers/users"
+	"avito-test-task-2023/internal/http-server/handlers/webhooks"
+	mwAuth "avito-test-task-2023/internal/http-server/middleware/auth"
+	mwIdempotency "avito-test-task-2023/internal/http-server/middleware/idempotency"
 	mwLogger "avito-test-task-2023/internal/http-server/middleware/logger"
+	mwMetrics "avito-test-task-2023/internal/http-server/middleware/metrics"
 	"avito-test-task-2023/internal/lib/logger/handlers/slogpretty"
 	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/metrics"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/outbox"
+	"avito-test-task-2023/internal/scheduler"
+	"avito-test-task-2023/internal/storage"
+	"avito-test-task-2023/internal/storage/cached"
+	"avito-test-task-2023/internal/storage/instrumented"
+	"avito-test-task-2023/internal/storage/memory"
 	"avito-test-task-2023/internal/storage/postgres"
+	"avito-test-task-2023/internal/worker"
 )
 
 const (
@@ -27,76 +56,397 @@ const (
 	envProd  = "prod"
 )
 
+const (
+	storagePostgres = "postgres"
+	storageMemory   = "memory"
+)
+
 // @title			Avito Test Task
 // @version			1.0
 // @description		User Segments Service
 // @host			localhost:8080
+//
+// @securityDefinitions.apikey	ApiKeyAuth
+// @in							header
+// @name						X-API-Key
 func main() {
 	cfg := config.MustLoad()
 
 	log := setupLogger(cfg.Env)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := runMigrate(ctx, cfg.Storage, os.Args[2:]); err != nil {
+				log.Error("migrate failed", sl.Err(err))
+				os.Exit(1)
+			}
+			return
+		case "apikey":
+			if err := runAPIKey(ctx, cfg.Storage, os.Args[2:]); err != nil {
+				log.Error("apikey failed", sl.Err(err))
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	log.Info(
 		"starting application",
 		slog.String("env", cfg.Env),
 	)
 
-	storage, err := postgres.New(cfg.Storage)
+	var m *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		m = metrics.New(cfg.Metrics.Namespace, cfg.Metrics.Buckets)
+	}
+
+	storage, err := setupStorage(ctx, cfg.Storage)
 	if err != nil {
 		log.Error("failed to init storage", sl.Err(err))
 		os.Exit(1)
 	}
 
-	go func() {
-		for {
-			deleted, err := storage.DeleteSegmentsTTL()
-			if err != nil {
-				log.Error("failed to delete segments (segments TTL)", err)
-			}
+	// pg is nil for the other backends
+	pg, _ := storage.(*postgres.Storage)
 
-			log.Info("TTL scheduler", slog.String("rows_deleted", strconv.FormatInt(deleted, 10)))
-			time.Sleep(1 * time.Minute)
+	if m != nil {
+		if pg != nil {
+			m.RegisterDBStats(pg.DB(), cfg.Storage.Database)
 		}
+
+		storage = instrumented.New(storage, m)
+	}
+
+	// the cache goes after the instrumentation, so storage metrics show the queries that reach the database
+	var cache *cached.Storage
+	if cfg.Cache.Enabled {
+		cache = cached.New(storage, cfg.Cache.Size, cfg.Cache.TTL, m)
+		storage = cache
+	}
+
+	if cfg.Auth.Enabled && cfg.Auth.BootstrapKey != "" {
+		if err := bootstrapAPIKey(ctx, storage, cfg.Auth.BootstrapKey); err != nil {
+			log.Error("failed to bootstrap api key", sl.Err(err))
+			os.Exit(1)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	ttlScheduler := scheduler.NewTTLScheduler(log, storage, cfg.Scheduler.TTLInterval, m)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ttlScheduler.Run(ctx)
 	}()
 
-	log.Info("delete scheduler started (segments TTL)")
+	if cache != nil && pg != nil {
+		listener := postgres.NewUserSegmentsListener(log, cfg.Storage, cache)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listener.Run(ctx)
+		}()
+	}
+
+	runner := worker.NewRunner(log, storage, cfg.Jobs)
+	runner.Register(job.TypeBulkEnroll, worker.NewBulkEnroll(storage))
+	runner.Register(job.TypeBulkRemove, worker.NewBulkRemove(storage))
+	runner.Register(job.TypePercentBackfill, worker.NewPercentBackfill(storage, storage))
+	runner.Register(job.TypeHistoryReport, worker.NewHistoryReport(storage, cfg.Reports.Dir))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runner.Run(ctx)
+	}()
+
+	dispatcher := outbox.NewDispatcher(log, storage, cfg.Webhooks, m)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dispatcher.Run(ctx)
+	}()
 
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
 	r.Use(mwLogger.New(log))
+	if m != nil {
+		r.Use(mwMetrics.New(m))
+	}
 	r.Use(middleware.Recoverer)
+	r.Use(middleware.Timeout(cfg.HTTPServer.Timeout))
 	r.Use(middleware.URLFormat)
 
+	// requireRole restricts a route to API keys granting the role, see the apikey package
+	requireRole := mwAuth.RequireRole
+	if cfg.Auth.Enabled {
+		r.Use(mwAuth.New(log, storage))
+	} else {
+		log.Warn("authentication is disabled")
+		requireRole = mwAuth.AllowAll
+	}
+
+	// idempotent follows requireRole in route groups, so rejected requests do not take idempotency keys
+	idempotent := mwIdempotency.New(log, storage, cfg.Idempotency, !cfg.Auth.Enabled)
+
 	r.Route("/users", func(r chi.Router) {
-		r.Post("/", users.NewUserSaver(log, storage))
-		r.Post("/{user_id}/configure-segments", users.NewUserSegmentConfigurer(log, storage))
-		r.Get("/{user_id}/segments", users.NewUserSegmentsGetter(log, storage))
+		r.With(requireRole(apikey.RoleReader)).Get("/{user_id}/segments", users.NewUserSegmentsGetter(log, storage))
+		r.With(requireRole(apikey.RoleReader)).Get("/{user_id}/assignments", users.NewUserAssignmentsGetter(log, storage))
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(apikey.RoleAnalyst))
+			r.Use(idempotent)
+
+			r.Post("/", users.NewUserSaver(log, storage))
+			r.Get("/", users.NewUserLister(log, storage))
+			r.Get("/{user_id}", users.NewUserGetter(log, storage))
+			r.Patch("/{user_id}", users.NewUserUpdater(log, storage))
+			r.Delete("/{user_id}", users.NewUserDeleter(log, storage))
+			r.Post("/{user_id}/configure-segments", users.NewUserSegmentConfigurer(log, storage))
+			r.Put("/{user_id}/segments", users.NewUserSegmentsSetter(log, storage))
+			r.Put("/{user_id}/attributes", users.NewUserAttributesSetter(log, storage))
+			r.Get("/{user_id}/history", users.NewUserHistoryGetter(log, storage, cfg.Reports.Dir))
+			r.Post("/{user_id}/history", users.NewUserHistoryReportEnqueuer(log, storage))
+		})
 	})
 
 	r.Route("/segments", func(r chi.Router) {
-		r.Post("/", segments.NewSegmentSaver(log, storage))
-		r.Get("/", segments.NewSegmentGetter(log, storage))
-		r.Delete("/{slug}", segments.NewSegmentDeleter(log, storage))
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(apikey.RoleAnalyst))
+			r.Use(idempotent)
+
+			r.Get("/", segments.NewSegmentGetter(log, storage))
+			r.Patch("/{slug}", segments.NewSegmentUpdater(log, storage))
+			r.Get("/{slug}/users", segments.NewSegmentMembersGetter(log, storage))
+			r.Post("/{slug}/users", segments.NewSegmentUsersAdder(log, storage))
+			r.Delete("/{slug}/users", segments.NewSegmentUsersRemover(log, storage))
+			r.Get("/{slug}/stats", segments.NewSegmentStatsGetter(log, storage))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(apikey.RoleAdmin))
+			r.Use(idempotent)
+
+			r.Post("/", segments.NewSegmentSaver(log, storage))
+			r.Delete("/{slug}", segments.NewSegmentDeleter(log, storage))
+		})
 	})
 
+	r.Route("/experiments", func(r chi.Router) {
+		r.With(requireRole(apikey.RoleAnalyst)).Get("/", experiments.NewExperimentLister(log, storage))
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(apikey.RoleAdmin))
+			r.Use(idempotent)
+
+			r.Post("/", experiments.NewExperimentSaver(log, storage))
+			r.Delete("/{slug}", experiments.NewExperimentDeleter(log, storage))
+		})
+	})
+
+	r.Route("/api-keys", func(r chi.Router) {
+		r.Use(requireRole(apikey.RoleAdmin))
+		r.Use(idempotent)
+
+		r.Post("/", apikeys.NewAPIKeySaver(log, storage))
+		r.Get("/", apikeys.NewAPIKeyLister(log, storage))
+		r.Delete("/{id}", apikeys.NewAPIKeyRevoker(log, storage))
+	})
+
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Use(requireRole(apikey.RoleAdmin))
+		r.Use(idempotent)
+
+		r.Post("/", webhooks.NewWebhookSaver(log, storage))
+		r.Get("/", webhooks.NewWebhookLister(log, storage))
+		r.Delete("/{id}", webhooks.NewWebhookDeleter(log, storage))
+	})
+
+	r.Route("/jobs", func(r chi.Router) {
+		r.Use(requireRole(apikey.RoleAnalyst))
+
+		r.Get("/{id}", jobs.NewJobGetter(log, storage))
+	})
+
+	r.With(requireRole(apikey.RoleAnalyst)).Handle("/reports/*", http.StripPrefix("/reports/", http.FileServer(http.Dir(cfg.Reports.Dir))))
+
+	r.Get("/healthz", health.NewLivenessHandler())
+	r.Get("/readyz", health.NewReadinessHandler(log, cfg.Health.CheckTimeout, readinessChecks(cfg.Health, storage, pg, ttlScheduler)...))
+
 	r.Get("/swagger/*", httpSwagger.Handler())
 
-	log.Info("starting server", slog.String("address", cfg.Address))
+	if m != nil {
+		r.Handle(cfg.Metrics.Path, m.Handler())
+	}
+
+	log.Info("starting server", slog.String("address", cfg.HTTPServer.Address))
 
 	srv := &http.Server{
-		Addr:         cfg.Address,
+		Addr:         cfg.HTTPServer.Address,
 		Handler:      r,
 		ReadTimeout:  cfg.HTTPServer.Timeout,
 		WriteTimeout: cfg.HTTPServer.Timeout,
 		IdleTimeout:  cfg.HTTPServer.IdleTimeout,
 	}
 
-	if err = srv.ListenAndServe(); err != nil {
-		log.Error("failed to start server")
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCServer.Enabled {
+		log.Info("starting grpc server", slog.String("address", cfg.GRPCServer.Address))
+
+		grpcSrv = setupGRPCServer(log, cfg, storage)
+		go func() {
+			lis, err := net.Listen("tcp", cfg.GRPCServer.Address)
+			if err != nil {
+				serverErr <- err
+				return
+			}
+
+			serverErr <- grpcSrv.Serve(lis)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Info("shutdown signal received")
+	case err := <-serverErr:
+		log.Error("failed to start server", sl.Err(err))
+	}
+
+	// stop the background jobs as well when the server failed on its own
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to stop server gracefully", sl.Err(err))
+	}
+
+	if grpcSrv != nil {
+		if err := stopGRPCServer(shutdownCtx, grpcSrv); err != nil {
+			log.Error("failed to stop grpc server gracefully", sl.Err(err))
+		}
+	}
+
+	wg.Wait()
+
+	if err := storage.Close(); err != nil {
+		log.Error("failed to close storage", sl.Err(err))
+	}
+
+	log.Info("server stopped")
+}
+
+// grpcMethodRoles are the roles required for the gRPC methods, the same as for the HTTP routes.
+// With auth enabled, unary methods missing here are denied.
+var grpcMethodRoles = map[string]string{
+	slugv1.SegmentService_CreateSegment_FullMethodName:      apikey.RoleAdmin,
+	slugv1.SegmentService_DeleteSegment_FullMethodName:      apikey.RoleAdmin,
+	slugv1.SegmentService_ListSegments_FullMethodName:       apikey.RoleAnalyst,
+	slugv1.UserService_ConfigureUserSegments_FullMethodName: apikey.RoleAnalyst,
+	slugv1.UserService_GetUserSegments_FullMethodName:       apikey.RoleReader,
+}
+
+func setupGRPCServer(log *slog.Logger, cfg *config.Config, s storage.Storage) *grpc.Server {
+	interceptors := []grpc.UnaryServerInterceptor{
+		grpcInterceptors.RequestID(),
+		grpcInterceptors.Logger(log),
+		grpcInterceptors.Recoverer(log),
+		grpcInterceptors.Timeout(cfg.GRPCServer.Timeout),
+	}
+	if cfg.Auth.Enabled {
+		interceptors = append(interceptors, grpcInterceptors.Auth(log, s, grpcMethodRoles))
 	}
 
-	log.Error("server stopped")
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+	slugv1.RegisterSegmentServiceServer(srv, services.NewSegmentService(log, s))
+	slugv1.RegisterUserServiceServer(srv, services.NewUserService(log, s))
+	reflection.Register(srv)
+
+	return srv
+}
+
+// stopGRPCServer waits for in-flight calls to complete until ctx is done and then closes the connections.
+func stopGRPCServer(ctx context.Context, srv *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+}
+
+func readinessChecks(
+	cfg config.Health,
+	s storage.Storage,
+	pg *postgres.Storage,
+	ttlScheduler *scheduler.TTLScheduler,
+) []health.Check {
+	checks := []health.Check{
+		{Name: "database", Check: s.Ping},
+		{Name: "ttl_sweeper", Check: func(context.Context) error {
+			lastRun := ttlScheduler.LastRun()
+			if lastRun.IsZero() {
+				return errors.New("has not run yet")
+			}
+
+			if age := time.Since(lastRun); age > cfg.TTLSweeperMaxAge {
+				return fmt.Errorf("last run %s ago", age.Round(time.Second))
+			}
+
+			return nil
+		}},
+	}
+
+	if pg != nil {
+		checks = append(checks, health.Check{Name: "migrations", Check: func(ctx context.Context) error {
+			pending, err := pg.PendingMigrations(ctx)
+			if err != nil {
+				return err
+			}
+
+			if pending > 0 {
+				return fmt.Errorf("%d pending migrations", pending)
+			}
+
+			return nil
+		}})
+	}
+
+	return checks
+}
+
+func setupStorage(ctx context.Context, cfg config.Storage) (storage.Storage, error) {
+	switch cfg.Type {
+	case storagePostgres:
+		s, err := postgres.New(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	case storageMemory:
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type: %q", cfg.Type)
+	}
 }
 
 func setupLogger(env string) *slog.Logger {
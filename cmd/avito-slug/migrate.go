@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/storage/postgres"
+	"avito-test-task-2023/internal/storage/postgres/migrate"
+)
+
+const migrateUsage = "usage: avito-slug migrate up|down [steps]|status"
+
+// runMigrate implements the "migrate" subcommand:
+//
+//	avito-slug migrate up           apply all pending migrations
+//	avito-slug migrate down [steps] roll back the last steps migrations (1 by default)
+//	avito-slug migrate status       print applied and pending migrations
+func runMigrate(ctx context.Context, cfg config.Storage, args []string) error {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New(migrateUsage)
+	}
+
+	if cfg.Type != storagePostgres {
+		return fmt.Errorf("migrations are supported by %q storage only, got %q", storagePostgres, cfg.Type)
+	}
+
+	db, err := postgres.Connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("applied %d_%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid steps %q: %s", args[1], migrateUsage)
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Printf("rolled back %d_%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no applied migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, st := range statuses {
+			appliedAt := "pending"
+			if st.AppliedAt != nil {
+				appliedAt = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
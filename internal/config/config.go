@@ -9,23 +9,136 @@ import (
 )
 
 type Config struct {
-	Env        string `yaml:"env" env-default:"local"`
-	HTTPServer `yaml:"http_server"`
-	Storage    `yaml:"storage"`
+	Env         string `yaml:"env" env-default:"local"`
+	HTTPServer  `yaml:"http_server"`
+	GRPCServer  `yaml:"grpc_server"`
+	Storage     `yaml:"storage"`
+	Reports     `yaml:"reports"`
+	Scheduler   `yaml:"scheduler"`
+	Metrics     `yaml:"metrics"`
+	Health      `yaml:"health"`
+	Auth        `yaml:"auth"`
+	Jobs        `yaml:"jobs"`
+	Idempotency `yaml:"idempotency"`
+	Cache       `yaml:"cache"`
+	Webhooks    `yaml:"webhooks"`
 }
 
 type HTTPServer struct {
 	Address     string        `yaml:"address" env-default:"localhost:8080"`
 	Timeout     time.Duration `yaml:"timeout" env-default:"4s"`
 	IdleTimeout time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	// ShutdownTimeout is how long in-flight requests are given to complete on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"10s"`
+}
+
+type GRPCServer struct {
+	// Enabled serves the gRPC API (see api/slug/v1) next to the HTTP one.
+	Enabled bool   `yaml:"enabled" env-default:"true"`
+	Address string `yaml:"address" env-default:"localhost:9090"`
+	// Timeout limits every call, the client deadline applies if it is shorter.
+	Timeout time.Duration `yaml:"timeout" env-default:"4s"`
 }
 
 type Storage struct {
+	// Type is the storage backend: "postgres" or "memory".
+	// The connection settings below are used by postgres only.
+	Type     string `yaml:"type" env-default:"postgres"`
 	Host     string `yaml:"host" env-default:"localhost"`
 	Port     string `yaml:"port" env-default:"5432"`
-	Database string `yaml:"database" env-required:"true"`
+	Database string `yaml:"database"`
 	Username string `yaml:"username" env-default:"postgres"`
-	Password string `yaml:"password" env-required:"true"`
+	Password string `yaml:"password"`
+	// QueryTimeout limits every storage operation, in addition to the request context.
+	QueryTimeout time.Duration `yaml:"query_timeout" env-default:"3s"`
+	// AutoMigrate applies pending migrations on startup.
+	AutoMigrate bool `yaml:"auto_migrate" env-default:"true"`
+}
+
+type Reports struct {
+	Dir string `yaml:"dir" env-default:"reports"`
+}
+
+type Scheduler struct {
+	// TTLInterval is how often expired user segments are deleted.
+	TTLInterval time.Duration `yaml:"ttl_interval" env-default:"1m"`
+}
+
+type Metrics struct {
+	Enabled   bool   `yaml:"enabled" env-default:"true"`
+	Path      string `yaml:"path" env-default:"/metrics"`
+	Namespace string `yaml:"namespace" env-default:"avito_slug"`
+	// Buckets are latency histogram buckets in seconds.
+	Buckets []float64 `yaml:"buckets" env-default:"0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5"`
+}
+
+type Health struct {
+	// CheckTimeout limits every readiness check.
+	CheckTimeout time.Duration `yaml:"check_timeout" env-default:"2s"`
+	// TTLSweeperMaxAge is how long ago the last successful TTL sweep may be before the service is not ready.
+	TTLSweeperMaxAge time.Duration `yaml:"ttl_sweeper_max_age" env-default:"3m"`
+}
+
+type Auth struct {
+	// Enabled requires an API key with a sufficient role on every API route.
+	// Health, metrics and swagger endpoints stay public.
+	Enabled bool `yaml:"enabled" env-default:"false"`
+	// BootstrapKey, if set, is stored as an admin API key on startup. It allows to create
+	// the first keys through the API, e.g. with the memory storage.
+	BootstrapKey string `yaml:"bootstrap_key" env:"AUTH_BOOTSTRAP_KEY"`
+}
+
+type Jobs struct {
+	// Workers is the number of jobs run concurrently by this instance.
+	Workers int `yaml:"workers" env-default:"2"`
+	// PollInterval is how often idle workers look for queued jobs.
+	PollInterval time.Duration `yaml:"poll_interval" env-default:"1s"`
+	// Lease is how long a job stays locked by a worker without a heartbeat. Jobs of crashed
+	// instances are picked up again after it expires.
+	Lease time.Duration `yaml:"lease" env-default:"30s"`
+	// MaxAttempts is how many times a job is picked up before it is failed.
+	MaxAttempts int `yaml:"max_attempts" env-default:"3"`
+}
+
+type Idempotency struct {
+	// TTL is how long responses to requests with an Idempotency-Key are replayed.
+	TTL time.Duration `yaml:"ttl" env-default:"24h"`
+	// LockTimeout is how long duplicates of a request in progress are rejected. A key of a request
+	// interrupted by a crash is released after it.
+	LockTimeout time.Duration `yaml:"lock_timeout" env-default:"1m"`
+	// MaxBodySize limits bodies of requests with an Idempotency-Key, which are read in full to be hashed.
+	MaxBodySize int64 `yaml:"max_body_size" env-default:"4194304"`
+}
+
+type Webhooks struct {
+	// Workers is the number of deliveries sent concurrently by this instance.
+	Workers int `yaml:"workers" env-default:"4"`
+	// PollInterval is how often outbox events and due deliveries are looked for.
+	PollInterval time.Duration `yaml:"poll_interval" env-default:"1s"`
+	// BatchSize is how many events or deliveries are taken at once.
+	BatchSize int `yaml:"batch_size" env-default:"100"`
+	// Timeout limits every webhook request.
+	Timeout time.Duration `yaml:"timeout" env-default:"5s"`
+	// Lease is how long claimed deliveries are hidden from other instances, it must exceed Timeout.
+	Lease time.Duration `yaml:"lease" env-default:"1m"`
+	// MaxAttempts is how many times a delivery is attempted before it is failed.
+	MaxAttempts int `yaml:"max_attempts" env-default:"10"`
+	// MinBackoff and MaxBackoff bound the delay before the next attempt, which doubles with every attempt.
+	MinBackoff time.Duration `yaml:"min_backoff" env-default:"1s"`
+	MaxBackoff time.Duration `yaml:"max_backoff" env-default:"1h"`
+}
+
+// maxCacheTTL keeps cached user segments actual within a minute, as the task requires.
+const maxCacheTTL = time.Minute
+
+type Cache struct {
+	// Enabled caches user segments in memory. With postgres the cache of every instance is invalidated
+	// on changes made by any of them.
+	Enabled bool `yaml:"enabled" env-default:"true"`
+	// Size is the maximum number of users whose segments are cached.
+	Size int `yaml:"size" env-default:"10000"`
+	// TTL is how long segments are cached, at most 1m. It bounds staleness when notifications are lost.
+	TTL time.Duration `yaml:"ttl" env-default:"30s"`
 }
 
 func MustLoad() *Config {
@@ -44,5 +157,13 @@ func MustLoad() *Config {
 		log.Fatalf("cannot read config: %s", err)
 	}
 
+	if cfg.Cache.TTL > maxCacheTTL {
+		log.Fatalf("cache ttl must be at most %s, got %s", maxCacheTTL, cfg.Cache.TTL)
+	}
+
+	if cfg.Webhooks.Lease <= cfg.Webhooks.Timeout {
+		log.Fatalf("webhooks lease must exceed the timeout %s, got %s", cfg.Webhooks.Timeout, cfg.Webhooks.Lease)
+	}
+
 	return &cfg
 }
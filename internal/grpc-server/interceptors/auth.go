@@ -0,0 +1,107 @@
+package interceptors
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/lib/secret"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/storage"
+)
+
+// MetadataAPIKey is the metadata key of the API key, like the X-API-Key header of the HTTP API.
+const MetadataAPIKey = "x-api-key"
+
+type APIKeyGetter interface {
+	GetAPIKeyByHash(ctx context.Context, hash string) (*apikey.APIKey, error)
+}
+
+// Auth authenticates calls by the API key in the x-api-key (or authorization: Bearer) metadata
+// and rejects calls whose key role does not grant the role required for the method.
+// roles is the allow-list: methods missing in it are denied, so a new RPC stays closed until it gets a role.
+// Server reflection is a streaming RPC and does not pass through this interceptor.
+func Auth(log *slog.Logger, getter APIKeyGetter, roles map[string]string) grpc.UnaryServerInterceptor {
+	log = log.With(
+		slog.String("component", "interceptors/auth"),
+	)
+
+	log.Info("auth interceptor enabled")
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		role, ok := roles[info.FullMethod]
+		if !ok {
+			log.Warn("method without role", slog.String("method", info.FullMethod))
+
+			return nil, status.Error(codes.PermissionDenied, "method not allowed")
+		}
+
+		key := keyFromMetadata(ctx)
+		if key == "" {
+			return nil, status.Error(codes.Unauthenticated, "api key required")
+		}
+
+		entry := log.With(
+			slog.String("method", info.FullMethod),
+			slog.String("request_id", middleware.GetReqID(ctx)),
+		)
+
+		apiKey, err := getter.GetAPIKeyByHash(ctx, secret.Hash(key))
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			entry.Info("unknown api key")
+
+			return nil, status.Error(codes.Unauthenticated, "invalid api key")
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			entry.Info("request interrupted", sl.Err(err))
+
+			return nil, status.FromContextError(err).Err()
+		}
+		if err != nil {
+			entry.Error("failed to get api key", sl.Err(err))
+
+			return nil, status.Error(codes.Internal, "failed to authenticate")
+		}
+
+		if apiKey.Revoked() {
+			entry.Info("revoked api key", slog.Int64("api_key_id", apiKey.ID))
+
+			return nil, status.Error(codes.Unauthenticated, "invalid api key")
+		}
+
+		if !apiKey.Allows(role) {
+			return nil, status.Error(codes.PermissionDenied, "insufficient role: "+role+" required")
+		}
+
+		entry.Debug("api key authenticated",
+			slog.Int64("api_key_id", apiKey.ID),
+			slog.String("role", apiKey.Role),
+		)
+
+		return handler(ctx, req)
+	}
+}
+
+func keyFromMetadata(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if keys := md.Get(MetadataAPIKey); len(keys) > 0 && keys[0] != "" {
+		return keys[0]
+	}
+
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,41 @@
+package interceptors
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Logger logs every call with its status code and duration.
+func Logger(log *slog.Logger) grpc.UnaryServerInterceptor {
+	log = log.With(
+		slog.String("component", "interceptors/logger"),
+	)
+
+	log.Info("logger interceptor enabled")
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		entry := log.With(
+			slog.String("method", info.FullMethod),
+			slog.String("request_id", middleware.GetReqID(ctx)),
+		)
+		if p, ok := peer.FromContext(ctx); ok {
+			entry = entry.With(slog.String("remote_addr", p.Addr.String()))
+		}
+
+		t1 := time.Now()
+		resp, err := handler(ctx, req)
+
+		entry.Info("request completed",
+			slog.String("code", status.Code(err).String()),
+			slog.String("duration", time.Since(t1).String()),
+		)
+
+		return resp, err
+	}
+}
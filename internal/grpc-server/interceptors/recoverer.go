@@ -0,0 +1,36 @@
+package interceptors
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Recoverer turns panics of handlers into INTERNAL errors, like chi's Recoverer middleware.
+func Recoverer(log *slog.Logger) grpc.UnaryServerInterceptor {
+	log = log.With(
+		slog.String("component", "interceptors/recoverer"),
+	)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Error("panic recovered",
+					slog.String("method", info.FullMethod),
+					slog.String("request_id", middleware.GetReqID(ctx)),
+					slog.Any("panic", rec),
+					slog.String("stack", string(debug.Stack())),
+				)
+
+				err = status.Error(codes.Internal, "internal error")
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
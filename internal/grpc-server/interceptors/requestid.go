@@ -0,0 +1,29 @@
+package interceptors
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataRequestID is the metadata key of the request id passed by the client.
+const MetadataRequestID = "x-request-id"
+
+// RequestID puts the request id into the context under the key of chi's RequestID middleware,
+// so it is logged the same way as for HTTP requests. It is taken from the x-request-id metadata
+// or generated.
+func RequestID() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		requestID := fmt.Sprintf("grpc-%06d", middleware.NextRequestID())
+		if ids := md.Get(MetadataRequestID); len(ids) > 0 && ids[0] != "" {
+			requestID = ids[0]
+		}
+
+		return handler(context.WithValue(ctx, middleware.RequestIDKey, requestID), req)
+	}
+}
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-playground/validator/v10"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	slugv1 "avito-test-task-2023/api/slug/v1"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/cursor"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+type SegmentStorage interface {
+	SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error)
+	DeleteSegmentBySlug(ctx context.Context, slug string) error
+	GetSegments(ctx context.Context, filter storage.SegmentFilter) ([]*segment.Segment, int64, error)
+}
+
+// SegmentService implements slugv1.SegmentServiceServer with the same rules as the /segments routes.
+type SegmentService struct {
+	slugv1.UnimplementedSegmentServiceServer
+
+	log     *slog.Logger
+	storage SegmentStorage
+}
+
+func NewSegmentService(log *slog.Logger, storage SegmentStorage) *SegmentService {
+	return &SegmentService{
+		log:     log,
+		storage: storage,
+	}
+}
+
+// pageCursor is the content of next_cursor, the same as of the HTTP API, so cursors are interchangeable.
+type pageCursor struct {
+	Sort string `json:"s"`
+	storage.SegmentCursor
+}
+
+func (s *SegmentService) CreateSegment(ctx context.Context, req *slugv1.CreateSegmentRequest) (*slugv1.CreateSegmentResponse, error) {
+	const op = "grpc.services.segments.CreateSegment"
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+
+	params := segment.Params{
+		Slug:        req.GetSlug(),
+		Description: req.GetDescription(),
+		Owner:       req.GetOwner(),
+		Tags:        req.GetTags(),
+		Status:      req.GetStatus(),
+		Percent:     int(req.GetPercent()),
+		Rule:        ruleFromProto(req.GetRule()),
+	}
+
+	if err := validator.New().Struct(params); err != nil {
+		validateErr := err.(validator.ValidationErrors)
+
+		log.Info("invalid request", sl.Err(err))
+
+		return nil, status.Error(codes.InvalidArgument, response.ValidationError(validateErr).Error)
+	}
+
+	if err := params.Rule.Validate(); err != nil {
+		log.Info("invalid rule", sl.Err(err))
+
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	seg := params.Segment()
+
+	usersAdded, err := s.storage.SaveSegment(ctx, seg)
+	if errors.Is(err, storage.ErrSegmentExists) {
+		log.Info("segment already exists", slog.String("slug", seg.Slug))
+
+		return nil, status.Error(codes.AlreadyExists, "segment already exists")
+	}
+	if st, ok := contextStatus(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		return nil, st.Err()
+	}
+	if err != nil {
+		log.Error("failed to create segment", sl.Err(err))
+
+		return nil, status.Error(codes.Internal, "failed to create segment")
+	}
+
+	log.Info("segment created", slog.Int("percent", seg.Percent), slog.Int64("users_added", usersAdded))
+
+	return &slugv1.CreateSegmentResponse{
+		Segment:    segmentToProto(seg),
+		UsersAdded: usersAdded,
+	}, nil
+}
+
+func (s *SegmentService) DeleteSegment(ctx context.Context, req *slugv1.DeleteSegmentRequest) (*slugv1.DeleteSegmentResponse, error) {
+	const op = "grpc.services.segments.DeleteSegment"
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+
+	if req.GetSlug() == "" {
+		log.Info("slug is empty")
+
+		return nil, status.Error(codes.InvalidArgument, "slug is required")
+	}
+
+	err := s.storage.DeleteSegmentBySlug(ctx, req.GetSlug())
+	if errors.Is(err, storage.ErrSegmentNotExists) {
+		log.Info("segment does not exist", slog.String("slug", req.GetSlug()))
+
+		return nil, status.Error(codes.NotFound, "segment does not exist")
+	}
+	if st, ok := contextStatus(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		return nil, st.Err()
+	}
+	if err != nil {
+		log.Error("failed to delete segment", sl.Err(err))
+
+		return nil, status.Error(codes.Internal, "failed to delete segment")
+	}
+
+	log.Info("segment deleted", slog.String("slug", req.GetSlug()))
+
+	return &slugv1.DeleteSegmentResponse{}, nil
+}
+
+func (s *SegmentService) ListSegments(ctx context.Context, req *slugv1.ListSegmentsRequest) (*slugv1.ListSegmentsResponse, error) {
+	const op = "grpc.services.segments.ListSegments"
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit < 1 || limit > maxListLimit {
+		log.Info("invalid limit", slog.Int("limit", limit))
+
+		return nil, status.Error(codes.InvalidArgument, "limit must be between 1 and 1000")
+	}
+
+	filter := storage.SegmentFilter{
+		Query:  req.GetQuery(),
+		Prefix: req.GetPrefix(),
+		Tags:   req.GetTags(),
+		Owner:  req.GetOwner(),
+		Status: req.GetStatus(),
+		Sort:   storage.SortSegmentsByID,
+		// one more segment tells whether there is a next page
+		Limit: limit + 1,
+	}
+
+	if filter.Status != "" && filter.Status != segment.StatusActive && filter.Status != segment.StatusArchived {
+		log.Info("invalid status", slog.String("status", filter.Status))
+
+		return nil, status.Error(codes.InvalidArgument, "status must be active or archived")
+	}
+
+	if sortParam := req.GetSort(); sortParam != "" {
+		filter.Sort, filter.Desc = strings.TrimPrefix(sortParam, "-"), strings.HasPrefix(sortParam, "-")
+
+		switch filter.Sort {
+		case storage.SortSegmentsByID, storage.SortSegmentsBySlug,
+			storage.SortSegmentsByCreatedAt, storage.SortSegmentsByUpdatedAt:
+		default:
+			log.Info("invalid sort", slog.String("sort", sortParam))
+
+			return nil, status.Error(codes.InvalidArgument, "sort must be one of: id, slug, created_at, updated_at")
+		}
+	}
+
+	if c := req.GetCursor(); c != "" {
+		var after pageCursor
+		if err := cursor.Decode(c, &after); err != nil || after.Sort != req.GetSort() {
+			log.Info("invalid cursor", slog.String("cursor", c))
+
+			return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+		}
+
+		filter.After = &after.SegmentCursor
+	}
+
+	segments, total, err := s.storage.GetSegments(ctx, filter)
+	if st, ok := contextStatus(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		return nil, st.Err()
+	}
+	if err != nil {
+		log.Error("failed to get segments", sl.Err(err))
+
+		return nil, status.Error(codes.Internal, "failed to get segments")
+	}
+
+	log.Info("segments retrieved", slog.Int("count", len(segments)), slog.Int64("total", total))
+
+	resp := &slugv1.ListSegmentsResponse{Total: total}
+
+	if len(segments) > limit {
+		segments = segments[:limit]
+
+		next, err := cursor.Encode(pageCursor{
+			Sort:          req.GetSort(),
+			SegmentCursor: *storage.NewSegmentCursor(segments[limit-1], filter.Sort),
+		})
+		if err != nil {
+			log.Error("failed to encode cursor", sl.Err(err))
+
+			return nil, status.Error(codes.Internal, "failed to get segments")
+		}
+
+		resp.NextCursor = next
+	}
+
+	resp.Segments = make([]*slugv1.Segment, len(segments))
+	for i, seg := range segments {
+		resp.Segments[i] = segmentToProto(seg)
+	}
+
+	return resp, nil
+}
+
+func segmentToProto(seg *segment.Segment) *slugv1.Segment {
+	pb := &slugv1.Segment{
+		Id:          seg.ID,
+		Slug:        seg.Slug,
+		Description: seg.Description,
+		Owner:       seg.Owner,
+		Tags:        seg.Tags,
+		Status:      seg.Status,
+		Percent:     int32(seg.Percent),
+	}
+
+	if !seg.CreatedAt.IsZero() {
+		pb.CreatedAt = timestamppb.New(seg.CreatedAt)
+	}
+	if !seg.UpdatedAt.IsZero() {
+		pb.UpdatedAt = timestamppb.New(seg.UpdatedAt)
+	}
+
+	for _, c := range seg.Rule {
+		condition := &slugv1.Condition{
+			Attribute: c.Attribute,
+			Operator:  c.Operator,
+		}
+		if c.Value != nil {
+			// values of a validated rule are JSON values, which are always converted
+			condition.Value, _ = structpb.NewValue(c.Value)
+		}
+		pb.Rule = append(pb.Rule, condition)
+	}
+
+	return pb
+}
+
+// ruleFromProto returns the rule with values decoded as from JSON, so it is validated like in the HTTP API.
+func ruleFromProto(conditions []*slugv1.Condition) segment.Rule {
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	rule := make(segment.Rule, len(conditions))
+	for i, c := range conditions {
+		rule[i] = segment.Condition{
+			Attribute: c.GetAttribute(),
+			Operator:  c.GetOperator(),
+		}
+		if c.GetValue() != nil {
+			rule[i].Value = c.GetValue().AsInterface()
+		}
+	}
+
+	return rule
+}
+
+// contextStatus returns the status of calls canceled by the client or timed out.
+func contextStatus(err error) (*status.Status, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err), true
+	}
+
+	return nil, false
+}
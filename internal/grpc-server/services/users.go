@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	slugv1 "avito-test-task-2023/api/slug/v1"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+type UserStorage interface {
+	ConfigureUserSegments(ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool) (*storage.ConfigureResult, error)
+	GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error)
+	GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) ([]string, error)
+}
+
+// UserService implements slugv1.UserServiceServer with the same rules as the /users routes.
+type UserService struct {
+	slugv1.UnimplementedUserServiceServer
+
+	log     *slog.Logger
+	storage UserStorage
+}
+
+func NewUserService(log *slog.Logger, storage UserStorage) *UserService {
+	return &UserService{
+		log:     log,
+		storage: storage,
+	}
+}
+
+func (s *UserService) ConfigureUserSegments(
+	ctx context.Context, req *slugv1.ConfigureUserSegmentsRequest,
+) (*slugv1.ConfigureUserSegmentsResponse, error) {
+	const op = "grpc.services.users.ConfigureUserSegments"
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+
+	// like with the HTTP API, unknown slugs, including empty ones, are rejected by the storage
+	segAdd := make([]storage.SegmentToAdd, len(req.GetSegmentsToAdd()))
+	for i, seg := range req.GetSegmentsToAdd() {
+		segAdd[i].Slug = seg.GetSlug()
+		if seg.GetDeleteAt() != nil {
+			deleteAt := seg.GetDeleteAt().AsTime()
+			segAdd[i].DeleteAt = &deleteAt
+		}
+	}
+
+	result, err := s.storage.ConfigureUserSegments(ctx, req.GetUserId(), segAdd, req.GetSegmentsToDelete(), req.GetLenient())
+	if errors.Is(err, storage.ErrUserNotFound) {
+		log.Info("user not found", slog.Int64("user_id", req.GetUserId()))
+
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if errors.Is(err, storage.ErrSegmentNotFound) {
+		log.Info("unknown segments", slog.Any("slugs", result.Unknown()))
+
+		return nil, rejectedStatus("unknown segments, no changes applied", result.Rejected)
+	}
+	if errors.Is(err, storage.ErrSegmentsRejected) {
+		log.Info("user segments rejected", slog.Any("rejected", result.Rejected))
+
+		return nil, rejectedStatus("segments rejected, no changes applied", result.Rejected)
+	}
+	if st, ok := contextStatus(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		return nil, st.Err()
+	}
+	if err != nil {
+		log.Error("failed to configure user segments", sl.Err(err))
+
+		return nil, status.Error(codes.Internal, "failed to configure user segments")
+	}
+
+	log.Info("user segments updated",
+		slog.Any("added", result.Added),
+		slog.Any("removed", result.Removed),
+		slog.Any("ignored", result.Ignored),
+	)
+
+	return &slugv1.ConfigureUserSegmentsResponse{
+		Added:   result.Added,
+		Removed: result.Removed,
+		Ignored: result.Ignored,
+	}, nil
+}
+
+func (s *UserService) GetUserSegments(ctx context.Context, req *slugv1.GetUserSegmentsRequest) (*slugv1.GetUserSegmentsResponse, error) {
+	const op = "grpc.services.users.GetUserSegments"
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+
+	if req.GetAt() != nil {
+		if err := req.GetAt().CheckValid(); err != nil {
+			log.Info("invalid at", sl.Err(err))
+
+			return nil, status.Error(codes.InvalidArgument, "invalid at")
+		}
+
+		at := req.GetAt().AsTime()
+		if at.After(time.Now()) {
+			log.Info("at is in the future", slog.Time("at", at))
+
+			return nil, status.Error(codes.InvalidArgument, "at must not be in the future")
+		}
+
+		slugs, err := s.storage.GetUserSegmentsAt(ctx, req.GetUserId(), at)
+		if st, ok := contextStatus(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			return nil, st.Err()
+		}
+		if err != nil {
+			log.Error("failed to get user segments at time", sl.Err(err))
+
+			return nil, status.Error(codes.Internal, "failed to get user segments")
+		}
+
+		log.Info("user segments at time retrieved", slog.Time("at", at))
+
+		return &slugv1.GetUserSegmentsResponse{Segments: slugs}, nil
+	}
+
+	segments, err := s.storage.GetUserSegments(ctx, req.GetUserId())
+	if st, ok := contextStatus(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		return nil, st.Err()
+	}
+	if err != nil {
+		log.Error("failed to get user segments", sl.Err(err))
+
+		return nil, status.Error(codes.Internal, "failed to get user segments")
+	}
+
+	log.Info("user segments retrieved")
+
+	slugs := make([]string, len(segments))
+	for i, seg := range segments {
+		slugs[i] = seg.Slug
+	}
+
+	return &slugv1.GetUserSegmentsResponse{Segments: slugs}, nil
+}
+
+// rejectedStatus is FAILED_PRECONDITION with the rejected segments as violations:
+// the slug is the subject and the reason is the description.
+func rejectedStatus(msg string, rejected []storage.RejectedSegment) error {
+	st := status.New(codes.FailedPrecondition, msg)
+
+	failure := &errdetails.PreconditionFailure{}
+	for _, rej := range rejected {
+		failure.Violations = append(failure.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "segment",
+			Subject:     rej.Slug,
+			Description: rej.Reason,
+		})
+	}
+
+	withDetails, err := st.WithDetails(failure)
+	if err != nil {
+		return st.Err()
+	}
+
+	return withDetails.Err()
+}
@@ -0,0 +1,73 @@
+package apikeys
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/apikey"
+)
+
+type ListResponse struct {
+	APIKeys []*apikey.APIKey `json:"api_keys"`
+}
+
+type ListResponseFailed struct {
+	response.Response
+}
+
+type APIKeyLister interface {
+	GetAPIKeys(ctx context.Context) ([]*apikey.APIKey, error)
+}
+
+// NewAPIKeyLister handles the HTTP request for listing API keys.
+//
+// @Summary List API keys
+// @Description Retrieve all API keys including revoked ones. Secrets are never returned.
+// @Tags api-keys
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} ListResponse
+// @Failure 401 {object} ListResponseFailed
+// @Failure 403 {object} ListResponseFailed
+// @Failure 500 {object} ListResponseFailed
+// @Router /api-keys [get]
+func NewAPIKeyLister(log *slog.Logger, apiKeyLister APIKeyLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.list.NewAPIKeyLister"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		apiKeys, err := apiKeyLister.GetAPIKeys(r.Context())
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get api keys", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get api keys"))
+			return
+		}
+
+		log.Info("api keys retrieved", slog.Int("count", len(apiKeys)))
+
+		if apiKeys == nil {
+			apiKeys = []*apikey.APIKey{}
+		}
+
+		render.JSON(w, r, ListResponse{APIKeys: apiKeys})
+	}
+}
@@ -0,0 +1,89 @@
+package apikeys
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
+)
+
+type RevokeResponse struct {
+	response.Response
+}
+
+type APIKeyRevoker interface {
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+// NewAPIKeyRevoker handles the HTTP request for revoking an API key.
+//
+// @Summary Revoke an API key
+// @Description Revoke an active API key. Requests with a revoked key are rejected.
+// @Tags api-keys
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "API key ID"
+// @Success 200 {object} RevokeResponse
+// @Failure 400 {object} RevokeResponse
+// @Failure 401 {object} RevokeResponse
+// @Failure 403 {object} RevokeResponse
+// @Failure 404 {object} RevokeResponse
+// @Failure 500 {object} RevokeResponse
+// @Router /api-keys/{id} [delete]
+func NewAPIKeyRevoker(log *slog.Logger, apiKeyRevoker APIKeyRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.revoke.NewAPIKeyRevoker"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Info("invalid api key id", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid api key id"))
+			return
+		}
+
+		err = apiKeyRevoker.RevokeAPIKey(r.Context(), id)
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			log.Info("api key not found", slog.Int64("api_key_id", id))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("api key not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to revoke api key", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to revoke api key"))
+			return
+		}
+
+		log.Info("api key revoked", slog.Int64("api_key_id", id))
+
+		render.JSON(w, r, RevokeResponse{
+			Response: response.OK(),
+		})
+	}
+}
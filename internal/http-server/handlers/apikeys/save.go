@@ -0,0 +1,125 @@
+package apikeys
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/lib/secret"
+	"avito-test-task-2023/internal/models/apikey"
+)
+
+type SaveRequest struct {
+	Name string `json:"name" validate:"required"`
+	Role string `json:"role" validate:"required,oneof=reader analyst admin"`
+}
+
+type SaveResponse struct {
+	response.Response
+	APIKey *apikey.APIKey `json:"api_key,omitempty"`
+	// Key is the secret, it is only returned once and stored hashed.
+	Key string `json:"key,omitempty"`
+}
+
+type APIKeySaver interface {
+	SaveAPIKey(ctx context.Context, name, role, hash string) (*apikey.APIKey, error)
+}
+
+// NewAPIKeySaver handles the HTTP request for creating an API key.
+//
+// @Summary Create an API key
+// @Description Create an API key with the given role: reader (read user segments), analyst (manage users
+// @Description and their segments) or admin (everything, including segments and API keys).
+// @Description The key is returned only once, store it securely.
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param request body SaveRequest true "Request body"
+// @Success 200 {object} SaveResponse
+// @Failure 400 {object} SaveResponse
+// @Failure 401 {object} SaveResponse
+// @Failure 403 {object} SaveResponse
+// @Failure 500 {object} SaveResponse
+// @Router /api-keys [post]
+func NewAPIKeySaver(log *slog.Logger, apiKeySaver APIKeySaver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.save.NewAPIKeySaver"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		var req SaveRequest
+
+		err := render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		key, err := secret.GenerateAPIKey()
+		if err != nil {
+			log.Error("failed to generate api key", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to create api key"))
+			return
+		}
+
+		apiKey, err := apiKeySaver.SaveAPIKey(r.Context(), req.Name, req.Role, secret.Hash(key))
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to save api key", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to create api key"))
+			return
+		}
+
+		log.Info("api key created", slog.Int64("api_key_id", apiKey.ID), slog.String("role", apiKey.Role))
+
+		render.JSON(w, r, SaveResponse{
+			Response: response.OK(),
+			APIKey:   apiKey,
+			Key:      key,
+		})
+	}
+}
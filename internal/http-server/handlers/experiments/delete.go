@@ -0,0 +1,88 @@
+package experiments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
+)
+
+type DeleteResponse struct {
+	response.Response
+}
+
+type ExperimentDeleter interface {
+	DeleteExperiment(ctx context.Context, slug string) error
+}
+
+// NewExperimentDeleter handles the HTTP request for deleting an experiment by slug.
+//
+// @Summary Delete an experiment
+// @Description Delete an experiment by its slug, users get no variant of it anymore.
+// @Tags experiments
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Experiment slug"
+// @Success 200 {object} DeleteResponse
+// @Failure 400 {object} DeleteResponse
+// @Failure 401 {object} DeleteResponse
+// @Failure 403 {object} DeleteResponse
+// @Failure 404 {object} DeleteResponse
+// @Failure 500 {object} DeleteResponse
+// @Router /experiments/{slug} [delete]
+func NewExperimentDeleter(log *slog.Logger, experimentDeleter ExperimentDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.experiments.delete.NewExperimentDeleter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+		if slug == "" {
+			log.Info("slug param is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		err := experimentDeleter.DeleteExperiment(r.Context(), slug)
+		if errors.Is(err, storage.ErrExperimentNotFound) {
+			log.Info("experiment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("experiment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to delete experiment", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to delete experiment"))
+			return
+		}
+
+		log.Info("experiment deleted", slog.String("slug", slug))
+
+		render.JSON(w, r, DeleteResponse{
+			Response: response.OK(),
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package experiments
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/experiment"
+)
+
+type ListResponse struct {
+	Experiments []*experiment.Experiment `json:"experiments"`
+}
+
+type ListResponseFailed struct {
+	response.Response
+}
+
+type ExperimentLister interface {
+	GetExperiments(ctx context.Context) ([]*experiment.Experiment, error)
+}
+
+// NewExperimentLister handles the HTTP request for listing experiments.
+//
+// @Summary List experiments
+// @Description Retrieve all experiments with their variants and weights.
+// @Tags experiments
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} ListResponse
+// @Failure 401 {object} ListResponseFailed
+// @Failure 403 {object} ListResponseFailed
+// @Failure 500 {object} ListResponseFailed
+// @Router /experiments [get]
+func NewExperimentLister(log *slog.Logger, experimentLister ExperimentLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.experiments.list.NewExperimentLister"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		experiments, err := experimentLister.GetExperiments(r.Context())
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get experiments", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get experiments"))
+			return
+		}
+
+		log.Info("experiments retrieved", slog.Int("count", len(experiments)))
+
+		if experiments == nil {
+			experiments = []*experiment.Experiment{}
+		}
+
+		render.JSON(w, r, ListResponse{Experiments: experiments})
+	}
+}
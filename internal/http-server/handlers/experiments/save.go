@@ -0,0 +1,156 @@
+package experiments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/storage"
+)
+
+type SaveRequest struct {
+	Slug        string `json:"slug" validate:"required"`
+	Description string `json:"description"`
+	// Segment limits the experiment to the users in the segment.
+	Segment  string           `json:"segment"`
+	Variants []VariantRequest `json:"variants" validate:"required,min=2,unique=Name,dive"`
+}
+
+type VariantRequest struct {
+	Name string `json:"name" validate:"required,max=255"`
+	// Weight is the percent of users getting the variant.
+	Weight int `json:"weight" validate:"gte=1,lte=100"`
+}
+
+type SaveResponse struct {
+	response.Response
+	Experiment *experiment.Experiment `json:"experiment,omitempty"`
+}
+
+type ExperimentSaver interface {
+	SaveExperiment(ctx context.Context, exp *experiment.Experiment) error
+}
+
+// NewExperimentSaver handles the HTTP request for creating an experiment.
+//
+// @Summary Create an experiment
+// @Description Create an experiment with at least two named variants. Every variant gets weight percent of users,
+// @Description chosen by a hash of the experiment slug and user id, so a user always gets the same variant.
+// @Description Weights add up to at most 100, the remaining users get no variant. With segment, only the users
+// @Description in the segment take part. Variants may not be changed later, since users would switch variants.
+// @Tags experiments
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param request body SaveRequest true "Request body"
+// @Success 200 {object} SaveResponse
+// @Failure 400 {object} SaveResponse
+// @Failure 401 {object} SaveResponse
+// @Failure 403 {object} SaveResponse
+// @Failure 404 {object} SaveResponse
+// @Failure 500 {object} SaveResponse
+// @Router /experiments [post]
+func NewExperimentSaver(log *slog.Logger, experimentSaver ExperimentSaver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.experiments.save.NewExperimentSaver"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		var req SaveRequest
+
+		err := render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		exp := &experiment.Experiment{
+			Slug:        req.Slug,
+			Description: req.Description,
+			Segment:     req.Segment,
+			Variants:    make([]experiment.Variant, len(req.Variants)),
+		}
+		for i, v := range req.Variants {
+			exp.Variants[i] = experiment.Variant{Name: v.Name, Weight: v.Weight}
+		}
+
+		if exp.TotalWeight() > 100 {
+			log.Info("weights exceed 100", slog.Int("total", exp.TotalWeight()))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("variant weights must add up to at most 100"))
+			return
+		}
+
+		err = experimentSaver.SaveExperiment(r.Context(), exp)
+		if errors.Is(err, storage.ErrExperimentExists) {
+			log.Info("experiment already exists", slog.String("slug", req.Slug))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("experiment already exists"))
+			return
+		}
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("segment", req.Segment))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to create experiment", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to create experiment"))
+			return
+		}
+
+		log.Info("experiment created", slog.String("slug", exp.Slug), slog.Int("variants", len(exp.Variants)))
+
+		render.JSON(w, r, SaveResponse{
+			Response:   response.OK(),
+			Experiment: exp,
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package health
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+)
+
+// Check is a single readiness dependency check. Check returns nil when the dependency is healthy.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// NewLivenessHandler handles the HTTP request for the liveness probe.
+//
+// @Summary Liveness probe
+// @Description Report that the process is up. Dependencies are not checked.
+// @Tags health
+// @Produce json
+// @Success 200 {object} response.Response
+// @Router /healthz [get]
+func NewLivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, response.OK())
+	}
+}
+
+// NewReadinessHandler handles the HTTP request for the readiness probe.
+// All checks run concurrently, each limited by timeout.
+//
+// @Summary Readiness probe
+// @Description Check the service dependencies: database connectivity, migration state and the TTL sweeper.
+// @Tags health
+// @Produce json
+// @Success 200 {object} ReadinessResponse
+// @Failure 503 {object} ReadinessResponse
+// @Router /readyz [get]
+func NewReadinessHandler(log *slog.Logger, timeout time.Duration, checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.health.health.NewReadinessHandler"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		results := make([]CheckResult, len(checks))
+
+		var wg sync.WaitGroup
+		for i, check := range checks {
+			wg.Add(1)
+			go func(i int, check Check) {
+				defer wg.Done()
+				results[i] = run(r.Context(), timeout, check)
+			}(i, check)
+		}
+		wg.Wait()
+
+		resp := ReadinessResponse{
+			Status: response.StatusOK,
+			Checks: make(map[string]CheckResult, len(checks)),
+		}
+
+		for i, check := range checks {
+			resp.Checks[check.Name] = results[i]
+
+			if results[i].Status != response.StatusOK {
+				resp.Status = response.StatusError
+
+				log.Warn("readiness check failed",
+					slog.String("check", check.Name),
+					slog.String("error", results[i].Error),
+				)
+			}
+		}
+
+		if resp.Status != response.StatusOK {
+			render.Status(r, http.StatusServiceUnavailable)
+		}
+
+		render.JSON(w, r, resp)
+	}
+}
+
+func run(ctx context.Context, timeout time.Duration, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Check(ctx)
+
+	res := CheckResult{
+		Status:   response.StatusOK,
+		Duration: time.Since(start).String(),
+	}
+
+	if err != nil {
+		res.Status = response.StatusError
+		res.Error = err.Error()
+	}
+
+	return res
+}
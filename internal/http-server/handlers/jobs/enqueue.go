@@ -0,0 +1,53 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/models/job"
+)
+
+// EnqueueResponse is returned with 202 Accepted by endpoints which run the work as a job.
+type EnqueueResponse struct {
+	response.Response
+	Job *job.Job `json:"job,omitempty"`
+	// Link is the URL of the job status.
+	Link string `json:"link,omitempty"`
+}
+
+type JobEnqueuer interface {
+	EnqueueJob(ctx context.Context, typ string, payload []byte) (*job.Job, error)
+}
+
+// Enqueue queues a job of the type with the JSON encoded payload.
+func Enqueue(ctx context.Context, enqueuer JobEnqueuer, typ string, payload any) (*job.Job, error) {
+	const op = "handlers.jobs.enqueue.Enqueue"
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return enqueuer.EnqueueJob(ctx, typ, data)
+}
+
+func NewEnqueueResponse(r *http.Request, j *job.Job) EnqueueResponse {
+	return EnqueueResponse{
+		Response: response.OK(),
+		Job:      j,
+		Link:     Link(r, j.ID),
+	}
+}
+
+// Link returns the URL of the job status.
+func Link(r *http.Request, id int64) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s/jobs/%d", scheme, r.Host, id)
+}
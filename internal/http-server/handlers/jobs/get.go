@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/storage"
+)
+
+type GetResponse struct {
+	response.Response
+	Job *job.Job `json:"job,omitempty"`
+}
+
+type JobGetter interface {
+	GetJob(ctx context.Context, id int64) (*job.Job, error)
+}
+
+// NewJobGetter handles the HTTP request for getting a job.
+//
+// @Summary Get a job
+// @Description Get the status of an asynchronous job. While the job runs, progress shows the number of processed
+// @Description items and result holds the partial result. A failed job has an error, a succeeded one has
+// @Description a result, e.g. the counts of changed users or a report link.
+// @Tags jobs
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "Job ID"
+// @Success 200 {object} GetResponse
+// @Failure 400 {object} GetResponse
+// @Failure 401 {object} GetResponse
+// @Failure 403 {object} GetResponse
+// @Failure 404 {object} GetResponse
+// @Failure 500 {object} GetResponse
+// @Router /jobs/{id} [get]
+func NewJobGetter(log *slog.Logger, jobGetter JobGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.get.NewJobGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Info("invalid job id", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid job id"))
+			return
+		}
+
+		j, err := jobGetter.GetJob(r.Context(), id)
+		if errors.Is(err, storage.ErrJobNotFound) {
+			log.Info("job not found", slog.Int64("job_id", id))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("job not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get job", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get job"))
+			return
+		}
+
+		render.JSON(w, r, GetResponse{
+			Response: response.OK(),
+			Job:      j,
+		})
+	}
+}
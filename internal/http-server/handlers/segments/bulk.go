@@ -0,0 +1,479 @@
+package segments
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/http-server/handlers/jobs"
+	"avito-test-task-2023/internal/lib/api/query"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/storage"
+)
+
+const (
+	// maxBulkUsers limits users of a single bulk request.
+	maxBulkUsers = 10000
+	// maxAsyncBulkUsers limits users of a single bulk request run as a job.
+	maxAsyncBulkUsers = 1000000
+)
+
+type BulkUserRequest struct {
+	UserID   int64      `json:"user_id" validate:"required,gt=0"`
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+type AddUsersRequest struct {
+	Users []BulkUserRequest `json:"users" validate:"required,dive"`
+	// DeleteAt is used for users without their own delete_at.
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+type RemoveUsersRequest struct {
+	UserIDs []int64 `json:"user_ids" validate:"required,dive,gt=0"`
+}
+
+type AddUsersResponse struct {
+	response.Response
+	Added  int64                 `json:"added"`
+	Failed []storage.BulkFailure `json:"failed,omitempty"`
+}
+
+type RemoveUsersResponse struct {
+	response.Response
+	Removed int64                 `json:"removed"`
+	Failed  []storage.BulkFailure `json:"failed,omitempty"`
+}
+
+type SegmentUsersAdder interface {
+	AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (*storage.BulkResult, error)
+	jobs.JobEnqueuer
+}
+
+type SegmentUsersRemover interface {
+	RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*storage.BulkResult, error)
+	jobs.JobEnqueuer
+}
+
+// NewSegmentUsersAdder handles the HTTP request for adding many users to a segment.
+//
+// @Summary Add users to a segment
+// @Description Add up to 10000 users to the segment. The body is either JSON or CSV (text/csv or a multipart
+// @Description file field) with user_id[,delete_at] rows, an optional header row is skipped.
+// @Description Users which can not be added are listed in failed, the others are added anyway.
+// @Description With async up to 1000000 users are added by a job, its status is returned with 202.
+// @Tags segments
+// @Accept json
+// @Accept text/csv
+// @Accept mpfd
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Segment slug"
+// @Param async query bool false "Run as a job"
+// @Param request body AddUsersRequest true "Request body"
+// @Success 200 {object} AddUsersResponse
+// @Success 202 {object} jobs.EnqueueResponse
+// @Failure 400 {object} AddUsersResponse
+// @Failure 401 {object} AddUsersResponse
+// @Failure 403 {object} AddUsersResponse
+// @Failure 404 {object} AddUsersResponse
+// @Failure 500 {object} AddUsersResponse
+// @Router /segments/{slug}/users [post]
+func NewSegmentUsersAdder(log *slog.Logger, usersAdder SegmentUsersAdder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.bulk.NewSegmentUsersAdder"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		async, err := query.Bool(r.URL.Query().Get("async"), false)
+		if err != nil {
+			log.Info("invalid async param", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid async"))
+			return
+		}
+
+		limit := maxBulkUsers
+		if async {
+			limit = maxAsyncBulkUsers
+		}
+
+		members, err := decodeBulkMembers(r, limit)
+		if err != nil {
+			log.Info("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, bulkErrorResponse(err))
+			return
+		}
+
+		if async {
+			payload := job.BulkEnrollPayload{Slug: slug, Users: make([]job.BulkUser, len(members))}
+			for i, member := range members {
+				payload.Users[i] = job.BulkUser{UserID: member.UserID, DeleteAt: member.DeleteAt}
+			}
+
+			enqueueJob(w, r, log, usersAdder, job.TypeBulkEnroll, payload)
+			return
+		}
+
+		result, err := usersAdder.AddSegmentUsers(r.Context(), slug, members)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err), slog.Any("result", result))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to add users to segment", sl.Err(err), slog.Any("result", result))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to add users to segment"))
+			return
+		}
+
+		log.Info("users added to segment",
+			slog.String("slug", slug),
+			slog.Int("requested", len(members)),
+			slog.Int64("added", result.Changed),
+			slog.Int("failed", len(result.Failed)),
+		)
+
+		render.JSON(w, r, AddUsersResponse{
+			Response: response.OK(),
+			Added:    result.Changed,
+			Failed:   result.Failed,
+		})
+	}
+}
+
+// NewSegmentUsersRemover handles the HTTP request for removing many users from a segment.
+//
+// @Summary Remove users from a segment
+// @Description Remove up to 10000 users from the segment. The body is either JSON or CSV (text/csv or
+// @Description a multipart file field) with a user_id column, an optional header row is skipped.
+// @Description Users which can not be removed are listed in failed, the others are removed anyway.
+// @Description With async up to 1000000 users are removed by a job, its status is returned with 202.
+// @Tags segments
+// @Accept json
+// @Accept text/csv
+// @Accept mpfd
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Segment slug"
+// @Param async query bool false "Run as a job"
+// @Param request body RemoveUsersRequest true "Request body"
+// @Success 200 {object} RemoveUsersResponse
+// @Success 202 {object} jobs.EnqueueResponse
+// @Failure 400 {object} RemoveUsersResponse
+// @Failure 401 {object} RemoveUsersResponse
+// @Failure 403 {object} RemoveUsersResponse
+// @Failure 404 {object} RemoveUsersResponse
+// @Failure 500 {object} RemoveUsersResponse
+// @Router /segments/{slug}/users [delete]
+func NewSegmentUsersRemover(log *slog.Logger, usersRemover SegmentUsersRemover) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.bulk.NewSegmentUsersRemover"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		async, err := query.Bool(r.URL.Query().Get("async"), false)
+		if err != nil {
+			log.Info("invalid async param", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid async"))
+			return
+		}
+
+		limit := maxBulkUsers
+		if async {
+			limit = maxAsyncBulkUsers
+		}
+
+		userIDs, err := decodeBulkUserIDs(r, limit)
+		if err != nil {
+			log.Info("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, bulkErrorResponse(err))
+			return
+		}
+
+		if async {
+			enqueueJob(w, r, log, usersRemover, job.TypeBulkRemove, job.BulkRemovePayload{Slug: slug, UserIDs: userIDs})
+			return
+		}
+
+		result, err := usersRemover.RemoveSegmentUsers(r.Context(), slug, userIDs)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err), slog.Any("result", result))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to remove users from segment", sl.Err(err), slog.Any("result", result))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to remove users from segment"))
+			return
+		}
+
+		log.Info("users removed from segment",
+			slog.String("slug", slug),
+			slog.Int("requested", len(userIDs)),
+			slog.Int64("removed", result.Changed),
+			slog.Int("failed", len(result.Failed)),
+		)
+
+		render.JSON(w, r, RemoveUsersResponse{
+			Response: response.OK(),
+			Removed:  result.Changed,
+			Failed:   result.Failed,
+		})
+	}
+}
+
+// enqueueJob queues a job doing the work of the request and responds with its status.
+func enqueueJob(w http.ResponseWriter, r *http.Request, log *slog.Logger, enqueuer jobs.JobEnqueuer, typ string, payload any) {
+	j, err := jobs.Enqueue(r.Context(), enqueuer, typ, payload)
+	if status, resp, ok := response.ContextError(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		render.Status(r, status)
+		render.JSON(w, r, resp)
+		return
+	}
+	if err != nil {
+		log.Error("failed to enqueue job", sl.Err(err))
+
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, response.Error("failed to enqueue job"))
+		return
+	}
+
+	log.Info("job enqueued", slog.Int64("job_id", j.ID), slog.String("type", typ))
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, jobs.NewEnqueueResponse(r, j))
+}
+
+func bulkErrorResponse(err error) response.Response {
+	var validateErr validator.ValidationErrors
+	if errors.As(err, &validateErr) {
+		return response.ValidationError(validateErr)
+	}
+
+	return response.Error(err.Error())
+}
+
+// decodeBulkMembers reads users to add from a JSON or CSV request body.
+func decodeBulkMembers(r *http.Request, limit int) ([]storage.BulkMember, error) {
+	csvBody, err := bulkCSV(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []storage.BulkMember
+
+	if csvBody != nil {
+		defer csvBody.Close()
+
+		err = readBulkCSV(csvBody, func(line int, record []string) error {
+			userID, err := parseUserID(line, record[0])
+			if err != nil {
+				return err
+			}
+
+			member := storage.BulkMember{UserID: userID}
+
+			if len(record) > 1 && strings.TrimSpace(record[1]) != "" {
+				deleteAt, err := time.Parse(time.RFC3339, strings.TrimSpace(record[1]))
+				if err != nil {
+					return fmt.Errorf("line %d: invalid delete_at %q", line, record[1])
+				}
+				member.DeleteAt = &deleteAt
+			}
+
+			members = append(members, member)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var req AddUsersRequest
+		if err := decodeBulkJSON(r, &req); err != nil {
+			return nil, err
+		}
+
+		members = make([]storage.BulkMember, len(req.Users))
+		for i, usr := range req.Users {
+			members[i] = storage.BulkMember{UserID: usr.UserID, DeleteAt: usr.DeleteAt}
+			if members[i].DeleteAt == nil {
+				members[i].DeleteAt = req.DeleteAt
+			}
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, errors.New("no users")
+	}
+	if len(members) > limit {
+		return nil, fmt.Errorf("at most %d users per request", limit)
+	}
+
+	return members, nil
+}
+
+// decodeBulkUserIDs reads ids of users to remove from a JSON or CSV request body.
+func decodeBulkUserIDs(r *http.Request, limit int) ([]int64, error) {
+	csvBody, err := bulkCSV(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []int64
+
+	if csvBody != nil {
+		defer csvBody.Close()
+
+		err = readBulkCSV(csvBody, func(line int, record []string) error {
+			userID, err := parseUserID(line, record[0])
+			if err != nil {
+				return err
+			}
+
+			userIDs = append(userIDs, userID)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var req RemoveUsersRequest
+		if err := decodeBulkJSON(r, &req); err != nil {
+			return nil, err
+		}
+
+		userIDs = req.UserIDs
+	}
+
+	if len(userIDs) == 0 {
+		return nil, errors.New("no users")
+	}
+	if len(userIDs) > limit {
+		return nil, fmt.Errorf("at most %d users per request", limit)
+	}
+
+	return userIDs, nil
+}
+
+// bulkCSV returns the CSV body of the request: the body itself for text/csv or
+// the "file" field of a multipart form. It returns nil for other content types.
+func bulkCSV(r *http.Request) (io.ReadCloser, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "text/csv":
+		return r.Body, nil
+	case "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file field: %w", err)
+		}
+
+		return file, nil
+	default:
+		return nil, nil
+	}
+}
+
+// readBulkCSV calls fn for every record of the CSV, skipping the header row if present.
+func readBulkCSV(body io.Reader, fn func(line int, record []string) error) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid csv: %w", err)
+		}
+
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "user_id") {
+			continue
+		}
+
+		if err := fn(line, record); err != nil {
+			return err
+		}
+	}
+}
+
+func parseUserID(line int, value string) (int64, error) {
+	userID, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, fmt.Errorf("line %d: invalid user_id %q", line, value)
+	}
+
+	return userID, nil
+}
+
+func decodeBulkJSON(r *http.Request, req any) error {
+	err := render.DecodeJSON(r.Body, req)
+	if errors.Is(err, io.EOF) {
+		return errors.New("empty request")
+	}
+	if err != nil {
+		return errors.New("failed to decode request")
+	}
+
+	return validator.New().Struct(req)
+}
@@ -1,6 +1,7 @@
 package segments
 
 import (
+	"context"
 	"errors"
 	"log/slog"
 	"net/http"
@@ -19,7 +20,7 @@ type DeleteResponse struct {
 }
 
 type SegmentDeleter interface {
-	DeleteSegmentBySlug(segmentName string) error
+	DeleteSegmentBySlug(ctx context.Context, segmentName string) error
 }
 
 // NewSegmentDeleter handles the HTTP request for deleting a segment by slug.
@@ -29,10 +30,13 @@ type SegmentDeleter interface {
 // @Tags segments
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
 // @Param slug path string true "Segment slug to delete"
 // @Success 200 {object} DeleteResponse
 // @Failure 400 {object} DeleteResponse
 // @Failure 404 {object} DeleteResponse
+// @Failure 401 {object} DeleteResponse
+// @Failure 403 {object} DeleteResponse
 // @Failure 500 {object} DeleteResponse
 // @Router /segments/{slug} [delete]
 func NewSegmentDeleter(log *slog.Logger, segmentDeleter SegmentDeleter) http.HandlerFunc {
@@ -53,7 +57,7 @@ func NewSegmentDeleter(log *slog.Logger, segmentDeleter SegmentDeleter) http.Han
 			return
 		}
 
-		err := segmentDeleter.DeleteSegmentBySlug(slug)
+		err := segmentDeleter.DeleteSegmentBySlug(r.Context(), slug)
 		if errors.Is(err, storage.ErrSegmentNotExists) {
 			log.Info("segment does not exist", slog.String("slug", slug))
 
@@ -61,6 +65,13 @@ func NewSegmentDeleter(log *slog.Logger, segmentDeleter SegmentDeleter) http.Han
 			render.JSON(w, r, response.Error("segment does not exist"))
 			return
 		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
 			log.Error("failed to delete segment", sl.Err(err))
 
@@ -1,19 +1,32 @@
 package segments
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 
+	"avito-test-task-2023/internal/lib/api/query"
 	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/cursor"
 	"avito-test-task-2023/internal/lib/logger/sl"
 	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
 )
 
 type GetResponse struct {
-	Segments []string `json:"segments"`
+	Segments []*segment.Segment `json:"segments"`
+	Total    int64              `json:"total"`
+	// NextCursor is passed as cursor to get the next page, it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type GetResponseFailed struct {
@@ -21,17 +34,37 @@ type GetResponseFailed struct {
 }
 
 type SegmentGetter interface {
-	GetSegments() ([]*segment.Segment, error)
+	GetSegments(ctx context.Context, filter storage.SegmentFilter) ([]*segment.Segment, int64, error)
+}
+
+// pageCursor is the content of next_cursor. It keeps the sort order,
+// so a cursor can not be used with a different one.
+type pageCursor struct {
+	Sort string `json:"s"`
+	storage.SegmentCursor
 }
 
-// NewSegmentGetter handles the HTTP request for retrieving user segments.
+// NewSegmentGetter handles the HTTP request for retrieving segments.
 //
-// @Summary Get user segments
-// @Description Retrieve a list of user segments.
+// @Summary Get segments
+// @Description Retrieve a page of segments with their metadata. Filters are combined with AND.
+// @Description Pass next_cursor of the response as cursor to get the next page.
 // @Tags segments
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
+// @Param limit query int false "Page size (default 50, max 1000)"
+// @Param cursor query string false "Cursor of the next page"
+// @Param q query string false "Case-insensitive slug substring"
+// @Param prefix query string false "Slug prefix"
+// @Param tag query []string false "Required tag, may be repeated" collectionFormat(multi)
+// @Param owner query string false "Owner team"
+// @Param status query string false "Segment status" Enums(active, archived)
+// @Param sort query string false "Sort order, prefix with - for descending (default id)" Enums(id, -id, slug, -slug, created_at, -created_at, updated_at, -updated_at)
 // @Success 200 {object} GetResponse
+// @Failure 400 {object} GetResponseFailed
+// @Failure 401 {object} GetResponseFailed
+// @Failure 403 {object} GetResponseFailed
 // @Failure 500 {object} GetResponseFailed
 // @Router /segments [get]
 func NewSegmentGetter(log *slog.Logger, segmentGetter SegmentGetter) http.HandlerFunc {
@@ -43,24 +76,103 @@ func NewSegmentGetter(log *slog.Logger, segmentGetter SegmentGetter) http.Handle
 			slog.String("request_id", middleware.GetReqID(r.Context())),
 		)
 
-		segments, err := segmentGetter.GetSegments()
+		params := r.URL.Query()
+
+		limit, err := query.Int(params.Get("limit"), defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			log.Info("invalid limit", slog.String("limit", params.Get("limit")))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("limit must be between 1 and 1000"))
+			return
+		}
+
+		filter := storage.SegmentFilter{
+			Query:  params.Get("q"),
+			Prefix: params.Get("prefix"),
+			Tags:   params["tag"],
+			Owner:  params.Get("owner"),
+			Status: params.Get("status"),
+			Sort:   storage.SortSegmentsByID,
+			// one more segment tells whether there is a next page
+			Limit: limit + 1,
+		}
+
+		if filter.Status != "" && filter.Status != segment.StatusActive && filter.Status != segment.StatusArchived {
+			log.Info("invalid status", slog.String("status", filter.Status))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("status must be active or archived"))
+			return
+		}
+
+		if sortParam := params.Get("sort"); sortParam != "" {
+			filter.Sort, filter.Desc = strings.TrimPrefix(sortParam, "-"), strings.HasPrefix(sortParam, "-")
+
+			switch filter.Sort {
+			case storage.SortSegmentsByID, storage.SortSegmentsBySlug,
+				storage.SortSegmentsByCreatedAt, storage.SortSegmentsByUpdatedAt:
+			default:
+				log.Info("invalid sort", slog.String("sort", sortParam))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("sort must be one of: id, slug, created_at, updated_at"))
+				return
+			}
+		}
+
+		if c := params.Get("cursor"); c != "" {
+			var after pageCursor
+			if err := cursor.Decode(c, &after); err != nil || after.Sort != params.Get("sort") {
+				log.Info("invalid cursor", slog.String("cursor", c))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("invalid cursor"))
+				return
+			}
+
+			filter.After = &after.SegmentCursor
+		}
+
+		segments, total, err := segmentGetter.GetSegments(r.Context(), filter)
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
-			log.Error("failed to get user segments", sl.Err(err))
+			log.Error("failed to get segments", sl.Err(err))
 
 			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, response.Error("failed to get user segments"))
+			render.JSON(w, r, response.Error("failed to get segments"))
 			return
 		}
 
-		log.Info("user segments retrieved")
+		log.Info("segments retrieved", slog.Int("count", len(segments)), slog.Int64("total", total))
 
-		segmentSlugs := make([]string, len(segments))
-		for i, seg := range segments {
-			segmentSlugs[i] = seg.Slug
+		resp := GetResponse{
+			Segments: segments,
+			Total:    total,
 		}
 
-		resp := GetResponse{
-			Segments: segmentSlugs,
+		if len(segments) > limit {
+			resp.Segments = segments[:limit]
+
+			next, err := cursor.Encode(pageCursor{
+				Sort:          params.Get("sort"),
+				SegmentCursor: *storage.NewSegmentCursor(segments[limit-1], filter.Sort),
+			})
+			if err != nil {
+				log.Error("failed to encode cursor", sl.Err(err))
+
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.Error("failed to get segments"))
+				return
+			}
+
+			resp.NextCursor = next
 		}
 
 		render.JSON(w, r, resp)
@@ -0,0 +1,159 @@
+package segments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/query"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/cursor"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+type MembersResponse struct {
+	Users []*segment.Member `json:"users"`
+	// NextCursor is passed as cursor to get the next page, it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type MembersResponseFailed struct {
+	response.Response
+}
+
+type SegmentMembersGetter interface {
+	GetSegmentMembers(ctx context.Context, slug string, filter storage.MemberFilter) ([]*segment.Member, error)
+}
+
+// membersCursor is the content of next_cursor of the members page.
+type membersCursor struct {
+	UserID int64 `json:"u"`
+}
+
+// NewSegmentMembersGetter handles the HTTP request for listing segment members.
+//
+// @Summary List segment members
+// @Description Retrieve a page of users in the segment ordered by user ID.
+// @Description Pass next_cursor of the response as cursor to get the next page.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Segment slug"
+// @Param limit query int false "Page size (default 50, max 1000)"
+// @Param cursor query string false "Cursor of the next page"
+// @Param include_expiring_before query string false "Only members removed by TTL before this time (RFC3339)"
+// @Success 200 {object} MembersResponse
+// @Failure 400 {object} MembersResponseFailed
+// @Failure 401 {object} MembersResponseFailed
+// @Failure 403 {object} MembersResponseFailed
+// @Failure 404 {object} MembersResponseFailed
+// @Failure 500 {object} MembersResponseFailed
+// @Router /segments/{slug}/users [get]
+func NewSegmentMembersGetter(log *slog.Logger, membersGetter SegmentMembersGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.members.NewSegmentMembersGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+		params := r.URL.Query()
+
+		limit, err := query.Int(params.Get("limit"), defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			log.Info("invalid limit", slog.String("limit", params.Get("limit")))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("limit must be between 1 and 1000"))
+			return
+		}
+
+		filter := storage.MemberFilter{
+			// one more member tells whether there is a next page
+			Limit: limit + 1,
+		}
+
+		if c := params.Get("cursor"); c != "" {
+			var after membersCursor
+			if err := cursor.Decode(c, &after); err != nil {
+				log.Info("invalid cursor", slog.String("cursor", c))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("invalid cursor"))
+				return
+			}
+
+			filter.AfterUserID = after.UserID
+		}
+
+		if before := params.Get("include_expiring_before"); before != "" {
+			expiringBefore, err := time.Parse(time.RFC3339, before)
+			if err != nil {
+				log.Info("invalid include_expiring_before", slog.String("include_expiring_before", before))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("include_expiring_before must be an RFC3339 time"))
+				return
+			}
+
+			filter.ExpiringBefore = &expiringBefore
+		}
+
+		members, err := membersGetter.GetSegmentMembers(r.Context(), slug, filter)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get segment members", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get segment members"))
+			return
+		}
+
+		log.Info("segment members retrieved", slog.String("slug", slug), slog.Int("count", len(members)))
+
+		resp := MembersResponse{
+			Users: members,
+		}
+
+		if len(members) > limit {
+			resp.Users = members[:limit]
+
+			next, err := cursor.Encode(membersCursor{UserID: members[limit-1].UserID})
+			if err != nil {
+				log.Error("failed to encode cursor", sl.Err(err))
+
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.Error("failed to get segment members"))
+				return
+			}
+
+			resp.NextCursor = next
+		}
+
+		render.JSON(w, r, resp)
+	}
+}
@@ -1,6 +1,7 @@
 package segments
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log/slog"
@@ -10,33 +11,54 @@ import (
 	"github.com/go-chi/render"
 	"github.com/go-playground/validator/v10"
 
+	"avito-test-task-2023/internal/http-server/handlers/jobs"
+	"avito-test-task-2023/internal/lib/api/query"
 	"avito-test-task-2023/internal/lib/api/response"
 	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/segment"
 	"avito-test-task-2023/internal/storage"
 )
 
 type SaveRequest struct {
-	Name string `json:"name" validate:"required"`
+	segment.Params
+	// Deprecated: Name is an alias of Slug kept for old clients.
+	Name string `json:"name,omitempty"`
 }
 
 type SaveResponse struct {
 	response.Response
+	Segment    *segment.Segment `json:"segment,omitempty"`
+	UsersAdded int64            `json:"users_added,omitempty"`
+	// Job enrolls existing users by percent, if the segment was saved with async.
+	Job     *job.Job `json:"job,omitempty"`
+	JobLink string   `json:"job_link,omitempty"`
 }
 
 type SegmentSaver interface {
-	SaveSegment(name string) error
+	SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error)
+	SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (*job.Job, error)
 }
 
 // NewSegmentSaver handles the HTTP request for saving a segment.
 //
 // @Summary Save a segment
-// @Description Save a new segment with the provided name.
+// @Description Save a new segment with the provided slug and metadata. The deprecated name field is accepted
+// @Description as an alias of slug. If percent is set, this share of users (including users created later)
+// @Description is automatically and deterministically added to the segment. With async, existing users
+// @Description are enrolled by a job returned with 202, users created meanwhile are enrolled right away.
+// @Description With rule, users whose attributes satisfy all of its conditions are in the segment as well.
 // @Tags segments
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
+// @Param async query bool false "Enroll existing users by a job"
 // @Param request body SaveRequest true "Request body"
 // @Success 200 {object} SaveResponse
+// @Success 202 {object} SaveResponse
 // @Failure 400 {object} SaveResponse
+// @Failure 401 {object} SaveResponse
+// @Failure 403 {object} SaveResponse
 // @Failure 500 {object} SaveResponse
 // @Router /segments [post]
 func NewSegmentSaver(log *slog.Logger, segmentSaver SegmentSaver) http.HandlerFunc {
@@ -48,9 +70,18 @@ func NewSegmentSaver(log *slog.Logger, segmentSaver SegmentSaver) http.HandlerFu
 			slog.String("request_id", middleware.GetReqID(r.Context())),
 		)
 
+		async, err := query.Bool(r.URL.Query().Get("async"), false)
+		if err != nil {
+			log.Info("invalid async param", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid async"))
+			return
+		}
+
 		var req SaveRequest
 
-		err := render.DecodeJSON(r.Body, &req)
+		err = render.DecodeJSON(r.Body, &req)
 		if errors.Is(err, io.EOF) {
 			log.Error("request body is empty")
 
@@ -68,6 +99,10 @@ func NewSegmentSaver(log *slog.Logger, segmentSaver SegmentSaver) http.HandlerFu
 
 		log.Info("request body decoded", slog.Any("request", req))
 
+		if req.Slug == "" {
+			req.Slug = req.Name
+		}
+
 		if err := validator.New().Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
@@ -78,14 +113,42 @@ func NewSegmentSaver(log *slog.Logger, segmentSaver SegmentSaver) http.HandlerFu
 			return
 		}
 
-		err = segmentSaver.SaveSegment(req.Name)
+		if err := req.Rule.Validate(); err != nil {
+			log.Info("invalid rule", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error(err.Error()))
+			return
+		}
+
+		seg := req.Segment()
+
+		// there is nothing to backfill without percent
+		async = async && req.Percent > 0
+
+		var (
+			usersAdded int64
+			j          *job.Job
+		)
+		if async {
+			j, err = segmentSaver.SaveSegmentAsync(r.Context(), seg)
+		} else {
+			usersAdded, err = segmentSaver.SaveSegment(r.Context(), seg)
+		}
 		if errors.Is(err, storage.ErrSegmentExists) {
-			log.Info("segment already exists", slog.String("name", req.Name))
+			log.Info("segment already exists", slog.String("slug", req.Slug))
 
 			render.Status(r, http.StatusBadRequest)
 			render.JSON(w, r, response.Error("segment already exists"))
 			return
 		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
 			log.Error("failed to create segment", sl.Err(err))
 
@@ -94,10 +157,25 @@ func NewSegmentSaver(log *slog.Logger, segmentSaver SegmentSaver) http.HandlerFu
 			return
 		}
 
-		log.Info("segment created")
+		if async {
+			log.Info("segment created", slog.Int("percent", req.Percent), slog.Int64("job_id", j.ID))
+
+			render.Status(r, http.StatusAccepted)
+			render.JSON(w, r, SaveResponse{
+				Response: response.OK(),
+				Segment:  seg,
+				Job:      j,
+				JobLink:  jobs.Link(r, j.ID),
+			})
+			return
+		}
+
+		log.Info("segment created", slog.Int("percent", req.Percent), slog.Int64("users_added", usersAdded))
 
 		render.JSON(w, r, SaveResponse{
-			Response: response.OK(),
+			Response:   response.OK(),
+			Segment:    seg,
+			UsersAdded: usersAdded,
 		})
 	}
 }
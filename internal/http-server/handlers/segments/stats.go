@@ -0,0 +1,80 @@
+package segments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+type StatsResponseFailed struct {
+	response.Response
+}
+
+type SegmentStatsGetter interface {
+	GetSegmentStats(ctx context.Context, slug string) (*segment.Stats, error)
+}
+
+// NewSegmentStatsGetter handles the HTTP request for segment statistics.
+//
+// @Summary Get segment statistics
+// @Description Retrieve the number of users in the segment and how many of them have a TTL set.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Segment slug"
+// @Success 200 {object} segment.Stats
+// @Failure 401 {object} StatsResponseFailed
+// @Failure 403 {object} StatsResponseFailed
+// @Failure 404 {object} StatsResponseFailed
+// @Failure 500 {object} StatsResponseFailed
+// @Router /segments/{slug}/stats [get]
+func NewSegmentStatsGetter(log *slog.Logger, statsGetter SegmentStatsGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.stats.NewSegmentStatsGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		stats, err := statsGetter.GetSegmentStats(r.Context(), slug)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get segment stats", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get segment stats"))
+			return
+		}
+
+		log.Info("segment stats retrieved", slog.String("slug", slug), slog.Int64("members", stats.Members))
+
+		render.JSON(w, r, stats)
+	}
+}
@@ -0,0 +1,160 @@
+package segments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/storage"
+)
+
+// UpdateRequest is a partial update, omitted fields are left unchanged.
+type UpdateRequest struct {
+	Description *string  `json:"description"`
+	Owner       *string  `json:"owner" validate:"omitempty,max=255"`
+	Tags        []string `json:"tags" validate:"dive,required,max=64"`
+	Status      *string  `json:"status" validate:"omitempty,oneof=active archived"`
+	// Rule replaces the rule of the segment, an empty list removes it.
+	Rule *segment.Rule `json:"rule"`
+}
+
+type UpdateResponse struct {
+	response.Response
+	Segment *segment.Segment `json:"segment,omitempty"`
+}
+
+type SegmentUpdater interface {
+	UpdateSegment(ctx context.Context, slug string, upd storage.SegmentUpdate) (*segment.Segment, error)
+}
+
+// NewSegmentUpdater handles the HTTP request for updating segment metadata.
+//
+// @Summary Update a segment
+// @Description Update the description, owner, tags, status or rule of a segment. Omitted fields are left unchanged,
+// @Description an empty tags list clears the tags, an empty rule makes the segment static.
+// @Tags segments
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param slug path string true "Segment slug"
+// @Param request body UpdateRequest true "Request body"
+// @Success 200 {object} UpdateResponse
+// @Failure 400 {object} UpdateResponse
+// @Failure 401 {object} UpdateResponse
+// @Failure 403 {object} UpdateResponse
+// @Failure 404 {object} UpdateResponse
+// @Failure 500 {object} UpdateResponse
+// @Router /segments/{slug} [patch]
+func NewSegmentUpdater(log *slog.Logger, segmentUpdater SegmentUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.update.NewSegmentUpdater"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		slug := chi.URLParam(r, "slug")
+		if slug == "" {
+			log.Info("slug param is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		var req UpdateRequest
+
+		err := render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		if req.Rule != nil {
+			if err := req.Rule.Validate(); err != nil {
+				log.Info("invalid rule", sl.Err(err))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error(err.Error()))
+				return
+			}
+		}
+
+		if req.Description == nil && req.Owner == nil && req.Tags == nil && req.Status == nil && req.Rule == nil {
+			log.Info("nothing to update")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("nothing to update"))
+			return
+		}
+
+		seg, err := segmentUpdater.UpdateSegment(r.Context(), slug, storage.SegmentUpdate{
+			Description: req.Description,
+			Owner:       req.Owner,
+			Tags:        req.Tags,
+			Status:      req.Status,
+			Rule:        req.Rule,
+		})
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("segment not found", slog.String("slug", slug))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("segment not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to update segment", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to update segment"))
+			return
+		}
+
+		log.Info("segment updated", slog.String("slug", slug))
+
+		render.JSON(w, r, UpdateResponse{
+			Response: response.OK(),
+			Segment:  seg,
+		})
+	}
+}
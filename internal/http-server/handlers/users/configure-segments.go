@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log/slog"
@@ -15,11 +16,14 @@ import (
 
 	"avito-test-task-2023/internal/lib/api/response"
 	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
 )
 
 type ConfigureSegmentsRequest struct {
 	SegmentsToAdd    []SegmentRequest `json:"segments_to_add"`
 	SegmentsToDelete []string         `json:"segments_to_delete"`
+	// Lenient skips unknown segments instead of rejecting the request.
+	Lenient bool `json:"lenient"`
 }
 
 type SegmentRequest struct {
@@ -29,23 +33,44 @@ type SegmentRequest struct {
 
 type ConfigureSegmentsResponse struct {
 	response.Response
+	Added    []string          `json:"added,omitempty"`
+	Removed  []string          `json:"removed,omitempty"`
+	Updated  []string          `json:"updated,omitempty"`
+	Rejected []RejectedSegment `json:"rejected,omitempty"`
+	Ignored  []string          `json:"ignored,omitempty"`
+
+	UnknownSegments []string `json:"unknown_segments,omitempty"`
+}
+
+type RejectedSegment struct {
+	Slug   string `json:"slug"`
+	Reason string `json:"reason"`
 }
 
 type UserSegmentConfigurer interface {
-	ConfigureUserSegments(userID int64, segAdd []SegmentRequest, segDel []string) error
+	ConfigureUserSegments(ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool) (*storage.ConfigureResult, error)
 }
 
 // NewUserSegmentConfigurer handles the HTTP request for configuring user segments.
 //
 // @Summary Configure user segments
 // @Description Configure user segments by adding and/or deleting segments for a user.
+// @Description All changes are applied in one transaction: if any segment is rejected, nothing is changed
+// @Description and the rejected segments are returned with the reason.
+// @Description Unknown segments are rejected with 422 unless "lenient" is set, in which case they are ignored.
 // @Tags users
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
 // @Param user_id path int true "User ID"
 // @Param request body ConfigureSegmentsRequest true "Request body"
 // @Success 200 {object} ConfigureSegmentsResponse
 // @Failure 400 {object} ConfigureSegmentsResponse
+// @Failure 404 {object} ConfigureSegmentsResponse
+// @Failure 409 {object} ConfigureSegmentsResponse
+// @Failure 422 {object} ConfigureSegmentsResponse
+// @Failure 401 {object} ConfigureSegmentsResponse
+// @Failure 403 {object} ConfigureSegmentsResponse
 // @Failure 500 {object} ConfigureSegmentsResponse
 // @Router /users/{user_id}/configure-segments [post]
 func NewUserSegmentConfigurer(log *slog.Logger, userSegmentConfigurer UserSegmentConfigurer) http.HandlerFunc {
@@ -92,6 +117,7 @@ func NewUserSegmentConfigurer(log *slog.Logger, userSegmentConfigurer UserSegmen
 
 			render.Status(r, http.StatusBadRequest)
 			render.JSON(w, r, response.Error("invalid request"))
+			return
 		}
 
 		if err := validator.New().Struct(req); err != nil {
@@ -104,7 +130,44 @@ func NewUserSegmentConfigurer(log *slog.Logger, userSegmentConfigurer UserSegmen
 			return
 		}
 
-		err = userSegmentConfigurer.ConfigureUserSegments(int64(userID), req.SegmentsToAdd, req.SegmentsToDelete)
+		result, err := userSegmentConfigurer.ConfigureUserSegments(
+			r.Context(), int64(userID), segmentsToAdd(req.SegmentsToAdd), req.SegmentsToDelete, req.Lenient,
+		)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("unknown segments", slog.Any("slugs", result.Unknown()))
+
+			render.Status(r, http.StatusUnprocessableEntity)
+			render.JSON(w, r, ConfigureSegmentsResponse{
+				Response:        response.Error("unknown segments, no changes applied"),
+				Rejected:        rejectedSegments(result.Rejected),
+				UnknownSegments: result.Unknown(),
+			})
+			return
+		}
+		if errors.Is(err, storage.ErrSegmentsRejected) {
+			log.Info("user segments rejected", slog.Any("rejected", result.Rejected))
+
+			render.Status(r, http.StatusConflict)
+			render.JSON(w, r, ConfigureSegmentsResponse{
+				Response: response.Error("segments rejected, no changes applied"),
+				Rejected: rejectedSegments(result.Rejected),
+			})
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
 			log.Error("failed to configure user segments", sl.Err(err))
 
@@ -113,10 +176,41 @@ func NewUserSegmentConfigurer(log *slog.Logger, userSegmentConfigurer UserSegmen
 			return
 		}
 
-		log.Info("user segments updated")
+		log.Info("user segments updated",
+			slog.Any("added", result.Added),
+			slog.Any("removed", result.Removed),
+			slog.Any("ignored", result.Ignored),
+		)
 
 		render.JSON(w, r, ConfigureSegmentsResponse{
 			Response: response.OK(),
+			Added:    result.Added,
+			Removed:  result.Removed,
+			Ignored:  result.Ignored,
 		})
 	}
 }
+
+func segmentsToAdd(segments []SegmentRequest) []storage.SegmentToAdd {
+	res := make([]storage.SegmentToAdd, len(segments))
+	for i, seg := range segments {
+		res[i] = storage.SegmentToAdd{
+			Slug:     seg.Slug,
+			DeleteAt: seg.DeleteAt,
+		}
+	}
+
+	return res
+}
+
+func rejectedSegments(rejected []storage.RejectedSegment) []RejectedSegment {
+	res := make([]RejectedSegment, len(rejected))
+	for i, rej := range rejected {
+		res[i] = RejectedSegment{
+			Slug:   rej.Slug,
+			Reason: rej.Reason,
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,90 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
+)
+
+type DeleteResponse struct {
+	response.Response
+}
+
+type UserDeleter interface {
+	DeleteUser(ctx context.Context, userID int64) error
+}
+
+// NewUserDeleter handles the HTTP request for deleting a user.
+//
+// @Summary Delete a user
+// @Description Delete a user by ID. The user's segments are removed and recorded in the history.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Success 200 {object} DeleteResponse
+// @Failure 400 {object} DeleteResponse
+// @Failure 404 {object} DeleteResponse
+// @Failure 401 {object} DeleteResponse
+// @Failure 403 {object} DeleteResponse
+// @Failure 500 {object} DeleteResponse
+// @Router /users/{user_id} [delete]
+func NewUserDeleter(log *slog.Logger, userDeleter UserDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.delete.NewUserDeleter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		err = userDeleter.DeleteUser(r.Context(), userID)
+		if errors.Is(err, storage.ErrUserNotExists) {
+			log.Info("user does not exist", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user does not exist"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to delete user", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to delete user"))
+			return
+		}
+
+		log.Info("user deleted", slog.Int64("user_id", userID))
+
+		render.JSON(w, r, DeleteResponse{
+			Response: response.OK(),
+		})
+	}
+}
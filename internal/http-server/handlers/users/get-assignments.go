@@ -0,0 +1,146 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+type GetAssignmentsResponse struct {
+	Assignments []experiment.Assignment `json:"assignments"`
+}
+
+type GetAssignmentsResponseFailed struct {
+	response.Response
+}
+
+type UserAssignmentsGetter interface {
+	GetUser(ctx context.Context, id int64) (*user.User, error)
+	GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error)
+	GetExperiments(ctx context.Context) ([]*experiment.Experiment, error)
+}
+
+// NewUserAssignmentsGetter handles the HTTP request for retrieving experiment variants of a user.
+//
+// @Summary Get user experiment assignments
+// @Description Retrieve the variant the user got in every experiment the user takes part in. Experiments
+// @Description with a segment only include the users in the segment, users left over by the weights get no variant.
+// @Tags users
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Success 200 {object} GetAssignmentsResponse
+// @Failure 400 {object} GetAssignmentsResponseFailed
+// @Failure 401 {object} GetAssignmentsResponseFailed
+// @Failure 403 {object} GetAssignmentsResponseFailed
+// @Failure 404 {object} GetAssignmentsResponseFailed
+// @Failure 500 {object} GetAssignmentsResponseFailed
+// @Router /users/{user_id}/assignments [get]
+func NewUserAssignmentsGetter(log *slog.Logger, assignmentsGetter UserAssignmentsGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.get-assignments.NewUserAssignmentsGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		assignments, err := userAssignments(r.Context(), assignmentsGetter, userID)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get user assignments", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get user assignments"))
+			return
+		}
+
+		log.Info("user assignments retrieved", slog.Int("count", len(assignments)))
+
+		render.JSON(w, r, GetAssignmentsResponse{
+			Assignments: assignments,
+		})
+	}
+}
+
+// userAssignments assigns the user to the experiments, the user segments are only read
+// if some experiment has a segment.
+func userAssignments(ctx context.Context, getter UserAssignmentsGetter, userID int64) ([]experiment.Assignment, error) {
+	if _, err := getter.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	experiments, err := getter.GetExperiments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var inSegment map[string]bool
+	for _, exp := range experiments {
+		if exp.Segment == "" {
+			continue
+		}
+
+		segments, err := getter.GetUserSegments(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		inSegment = make(map[string]bool, len(segments))
+		for _, seg := range segments {
+			inSegment[seg.Slug] = true
+		}
+		break
+	}
+
+	assignments := []experiment.Assignment{}
+	for _, exp := range experiments {
+		if exp.Segment != "" && !inSegment[exp.Segment] {
+			continue
+		}
+
+		if variant, ok := exp.Assign(userID); ok {
+			assignments = append(assignments, experiment.Assignment{
+				Experiment: exp.Slug,
+				Variant:    variant,
+			})
+		}
+	}
+
+	return assignments, nil
+}
@@ -1,9 +1,11 @@
 package users
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -23,19 +25,26 @@ type GetSegmentsResponseFailed struct {
 }
 
 type UserSegmentsGetter interface {
-	GetUserSegments(userID int64) ([]*segment.Segment, error)
+	GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error)
+	GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) ([]string, error)
 }
 
 // NewUserSegmentsGetter handles the HTTP request for retrieving segments of a user.
 //
 // @Summary Get user segments
-// @Description Retrieve segments associated with a user by user ID.
+// @Description Retrieve segments associated with a user by user ID, including segments whose rule matches
+// @Description the user's attributes. With at, the segments the user had at that time are reconstructed from
+// @Description the membership history, including TTL expiries and deletions; rules are not kept in the history.
 // @Tags users
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
 // @Param user_id path int true "User ID"
+// @Param at query string false "Point in time in RFC3339 format"
 // @Success 200 {object} GetSegmentsResponse
 // @Failure 400 {object} GetSegmentsResponseFailed
+// @Failure 401 {object} GetSegmentsResponseFailed
+// @Failure 403 {object} GetSegmentsResponseFailed
 // @Failure 500 {object} GetSegmentsResponseFailed
 // @Router /users/{user_id}/segments [get]
 func NewUserSegmentsGetter(log *slog.Logger, userSegmentsGetter UserSegmentsGetter) http.HandlerFunc {
@@ -62,9 +71,58 @@ func NewUserSegmentsGetter(log *slog.Logger, userSegmentsGetter UserSegmentsGett
 
 			render.Status(r, http.StatusBadRequest)
 			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		if atStr := r.URL.Query().Get("at"); atStr != "" {
+			at, err := time.Parse(time.RFC3339, atStr)
+			if err != nil {
+				log.Info("invalid at", slog.String("at", atStr))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("at must be in RFC3339 format"))
+				return
+			}
+			if at.After(time.Now()) {
+				log.Info("at is in the future", slog.String("at", atStr))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("at must not be in the future"))
+				return
+			}
+
+			segmentSlugs, err := userSegmentsGetter.GetUserSegmentsAt(r.Context(), int64(userID), at)
+			if status, resp, ok := response.ContextError(err); ok {
+				log.Info("request interrupted", sl.Err(err))
+
+				render.Status(r, status)
+				render.JSON(w, r, resp)
+				return
+			}
+			if err != nil {
+				log.Error("failed to get user segments at time", sl.Err(err))
+
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.Error("failed to get user segments"))
+				return
+			}
+
+			log.Info("user segments at time retrieved", slog.Time("at", at))
+
+			render.JSON(w, r, GetSegmentsResponse{
+				Segments: segmentSlugs,
+			})
+			return
 		}
 
-		segments, err := userSegmentsGetter.GetUserSegments(int64(userID))
+		segments, err := userSegmentsGetter.GetUserSegments(r.Context(), int64(userID))
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
 			log.Error("failed to get user segments", sl.Err(err))
 
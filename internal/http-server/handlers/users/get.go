@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+type GetResponse struct {
+	User *user.User `json:"user"`
+}
+
+type GetResponseFailed struct {
+	response.Response
+}
+
+type UserGetter interface {
+	GetUser(ctx context.Context, id int64) (*user.User, error)
+}
+
+// NewUserGetter handles the HTTP request for retrieving a user.
+//
+// @Summary Get a user
+// @Description Retrieve a user by ID.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Success 200 {object} GetResponse
+// @Failure 400 {object} GetResponseFailed
+// @Failure 404 {object} GetResponseFailed
+// @Failure 401 {object} GetResponseFailed
+// @Failure 403 {object} GetResponseFailed
+// @Failure 500 {object} GetResponseFailed
+// @Router /users/{user_id} [get]
+func NewUserGetter(log *slog.Logger, userGetter UserGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.get.NewUserGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		usr, err := userGetter.GetUser(r.Context(), userID)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get user", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get user"))
+			return
+		}
+
+		log.Info("user retrieved", slog.Int64("user_id", userID))
+
+		render.JSON(w, r, GetResponse{
+			User: usr,
+		})
+	}
+}
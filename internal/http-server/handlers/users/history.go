@@ -0,0 +1,245 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/http-server/handlers/jobs"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/lib/report"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+type HistoryResponse struct {
+	response.Response
+	Link string `json:"link,omitempty"`
+}
+
+type UserHistoryGetter interface {
+	GetUser(ctx context.Context, id int64) (*user.User, error)
+	GetUserHistory(ctx context.Context, userID int64, from, to time.Time) ([]*history.Record, error)
+}
+
+type UserHistoryReportEnqueuer interface {
+	GetUser(ctx context.Context, id int64) (*user.User, error)
+	jobs.JobEnqueuer
+}
+
+// NewUserHistoryGetter handles the HTTP request for generating a user history report.
+//
+// @Summary Get user history report
+// @Description Generate a CSV report of the user's segment additions and removals for the given month and return a link to it.
+// @Description Long reports should be requested with POST, which generates them by a job.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Param period query string true "Report period in YYYY-MM format"
+// @Success 200 {object} HistoryResponse
+// @Failure 400 {object} HistoryResponse
+// @Failure 401 {object} HistoryResponse
+// @Failure 403 {object} HistoryResponse
+// @Failure 404 {object} HistoryResponse
+// @Failure 500 {object} HistoryResponse
+// @Router /users/{user_id}/history [get]
+func NewUserHistoryGetter(log *slog.Logger, historyGetter UserHistoryGetter, reportsDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.history.NewUserHistoryGetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userIDStr := chi.URLParam(r, "user_id")
+		if userIDStr == "" {
+			log.Info("user_id param is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			log.Error("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		from, err := time.Parse(report.PeriodLayout, period)
+		if err != nil {
+			log.Info("invalid period", slog.String("period", period))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("period must be in YYYY-MM format"))
+			return
+		}
+		to := from.AddDate(0, 1, 0)
+
+		if !userExists(w, r, log, historyGetter, int64(userID)) {
+			return
+		}
+
+		records, err := historyGetter.GetUserHistory(r.Context(), int64(userID), from, to)
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get user history", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get user history"))
+			return
+		}
+
+		name := report.HistoryFileName(int64(userID), period)
+		if err := report.WriteHistoryCSV(reportsDir, name, records); err != nil {
+			log.Error("failed to write history report", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to generate report"))
+			return
+		}
+
+		log.Info("user history report generated", slog.String("report", name), slog.Int("records", len(records)))
+
+		render.JSON(w, r, HistoryResponse{
+			Response: response.OK(),
+			Link:     reportLink(r, name),
+		})
+	}
+}
+
+// NewUserHistoryReportEnqueuer handles the HTTP request for generating a user history report by a job.
+//
+// @Summary Generate user history report
+// @Description Queue a job generating a CSV report of the user's segment additions and removals for the given month.
+// @Description The job result holds a link to the report.
+// @Tags users
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Param period query string true "Report period in YYYY-MM format"
+// @Success 202 {object} jobs.EnqueueResponse
+// @Failure 400 {object} jobs.EnqueueResponse
+// @Failure 401 {object} jobs.EnqueueResponse
+// @Failure 403 {object} jobs.EnqueueResponse
+// @Failure 404 {object} jobs.EnqueueResponse
+// @Failure 500 {object} jobs.EnqueueResponse
+// @Router /users/{user_id}/history [post]
+func NewUserHistoryReportEnqueuer(log *slog.Logger, enqueuer UserHistoryReportEnqueuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.history.NewUserHistoryReportEnqueuer"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("invalid user_id", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if _, err := time.Parse(report.PeriodLayout, period); err != nil {
+			log.Info("invalid period", slog.String("period", period))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("period must be in YYYY-MM format"))
+			return
+		}
+
+		if !userExists(w, r, log, enqueuer, userID) {
+			return
+		}
+
+		j, err := jobs.Enqueue(r.Context(), enqueuer, job.TypeHistoryReport, job.HistoryReportPayload{
+			UserID: userID,
+			Period: period,
+			Link:   reportLink(r, report.HistoryFileName(userID, period)),
+		})
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to enqueue history report", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to enqueue job"))
+			return
+		}
+
+		log.Info("history report enqueued", slog.Int64("job_id", j.ID))
+
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, jobs.NewEnqueueResponse(r, j))
+	}
+}
+
+// userExists responds with 404 if there is no such user, so no empty report is made for it.
+func userExists(w http.ResponseWriter, r *http.Request, log *slog.Logger, userGetter UserGetter, userID int64) bool {
+	_, err := userGetter.GetUser(r.Context(), userID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		log.Info("user not found", slog.Int64("user_id", userID))
+
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, response.Error("user not found"))
+		return false
+	}
+	if status, resp, ok := response.ContextError(err); ok {
+		log.Info("request interrupted", sl.Err(err))
+
+		render.Status(r, status)
+		render.JSON(w, r, resp)
+		return false
+	}
+	if err != nil {
+		log.Error("failed to get user", sl.Err(err))
+
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, response.Error("failed to get user"))
+		return false
+	}
+
+	return true
+}
+
+func reportLink(r *http.Request, name string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s/reports/%s", scheme, r.Host, name)
+}
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/query"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/user"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+type ListResponse struct {
+	Users []*user.User `json:"users"`
+	Total int64        `json:"total"`
+}
+
+type ListResponseFailed struct {
+	response.Response
+}
+
+type UserLister interface {
+	GetUsers(ctx context.Context, limit, offset int, name string) ([]*user.User, int64, error)
+}
+
+// NewUserLister handles the HTTP request for listing users.
+//
+// @Summary List users
+// @Description Retrieve a page of users ordered by ID, optionally filtered by a name substring.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param limit query int false "Page size (default 50, max 1000)"
+// @Param offset query int false "Number of users to skip"
+// @Param name query string false "Case-insensitive name substring"
+// @Success 200 {object} ListResponse
+// @Failure 400 {object} ListResponseFailed
+// @Failure 401 {object} ListResponseFailed
+// @Failure 403 {object} ListResponseFailed
+// @Failure 500 {object} ListResponseFailed
+// @Router /users [get]
+func NewUserLister(log *slog.Logger, userLister UserLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.list.NewUserLister"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		params := r.URL.Query()
+
+		limit, err := query.Int(params.Get("limit"), defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			log.Info("invalid limit", slog.String("limit", params.Get("limit")))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("limit must be between 1 and 1000"))
+			return
+		}
+
+		offset, err := query.Int(params.Get("offset"), 0)
+		if err != nil || offset < 0 {
+			log.Info("invalid offset", slog.String("offset", params.Get("offset")))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("offset must be a non-negative integer"))
+			return
+		}
+
+		users, total, err := userLister.GetUsers(r.Context(), limit, offset, params.Get("name"))
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get users", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get users"))
+			return
+		}
+
+		log.Info("users retrieved", slog.Int("count", len(users)), slog.Int64("total", total))
+
+		render.JSON(w, r, ListResponse{
+			Users: users,
+			Total: total,
+		})
+	}
+}
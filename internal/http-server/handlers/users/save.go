@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log/slog"
@@ -12,31 +13,39 @@ import (
 
 	"avito-test-task-2023/internal/lib/api/response"
 	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/user"
 	"avito-test-task-2023/internal/storage"
 )
 
 type SaveRequest struct {
 	Name string `json:"name" validate:"required"`
+	// Attributes are matched by segment rules, see user.Attributes.
+	Attributes user.Attributes `json:"attributes,omitempty"`
 }
 
 type SaveResponse struct {
 	response.Response
+	User *user.User `json:"user,omitempty"`
 }
 
 type UserSaver interface {
-	SaveUser(name string) error
+	SaveUser(ctx context.Context, name string, attrs user.Attributes) (*user.User, error)
 }
 
 // NewUserSaver handles the HTTP request for saving a user.
 //
 // @Summary Save a user
-// @Description Save a new user with the provided name.
+// @Description Save a new user with the provided name and optional attributes: strings, numbers or booleans
+// @Description matched by segment rules.
 // @Tags users
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
 // @Param request body SaveRequest true "Request body"
 // @Success 200 {object} SaveResponse
 // @Failure 400 {object} SaveResponse
+// @Failure 401 {object} SaveResponse
+// @Failure 403 {object} SaveResponse
 // @Failure 500 {object} SaveResponse
 // @Router /users [post]
 func NewUserSaver(log *slog.Logger, userSaver UserSaver) http.HandlerFunc {
@@ -78,7 +87,15 @@ func NewUserSaver(log *slog.Logger, userSaver UserSaver) http.HandlerFunc {
 			return
 		}
 
-		err = userSaver.SaveUser(req.Name)
+		if err := req.Attributes.Validate(); err != nil {
+			log.Info("invalid attributes", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error(err.Error()))
+			return
+		}
+
+		usr, err := userSaver.SaveUser(r.Context(), req.Name, req.Attributes)
 		if errors.Is(err, storage.ErrUserExists) {
 			log.Info("user already exists", slog.String("name", req.Name))
 
@@ -86,6 +103,13 @@ func NewUserSaver(log *slog.Logger, userSaver UserSaver) http.HandlerFunc {
 			render.JSON(w, r, response.Error("user already exists"))
 			return
 		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
 		if err != nil {
 			log.Error("failed to create user", sl.Err(err))
 
@@ -94,10 +118,11 @@ func NewUserSaver(log *slog.Logger, userSaver UserSaver) http.HandlerFunc {
 			return
 		}
 
-		log.Info("user created")
+		log.Info("user created", slog.Int64("id", usr.ID))
 
 		render.JSON(w, r, SaveResponse{
 			Response: response.OK(),
+			User:     usr,
 		})
 	}
 }
@@ -0,0 +1,140 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+type SetAttributesRequest struct {
+	// Attributes replace all attributes of the user, an empty object clears them.
+	Attributes user.Attributes `json:"attributes" validate:"required"`
+}
+
+type SetAttributesResponse struct {
+	response.Response
+	User *user.User `json:"user,omitempty"`
+}
+
+type UserAttributesSetter interface {
+	SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (*user.User, error)
+}
+
+// NewUserAttributesSetter handles the HTTP request for replacing attributes of a user.
+//
+// @Summary Set user attributes
+// @Description Replace all attributes of a user: at most 50 strings, numbers or booleans.
+// @Description Segments with rules include or exclude the user by the new attributes right away.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Param request body SetAttributesRequest true "Request body"
+// @Success 200 {object} SetAttributesResponse
+// @Failure 400 {object} SetAttributesResponse
+// @Failure 401 {object} SetAttributesResponse
+// @Failure 403 {object} SetAttributesResponse
+// @Failure 404 {object} SetAttributesResponse
+// @Failure 500 {object} SetAttributesResponse
+// @Router /users/{user_id}/attributes [put]
+func NewUserAttributesSetter(log *slog.Logger, attributesSetter UserAttributesSetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.set-attributes.NewUserAttributesSetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		var req SetAttributesRequest
+
+		err = render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		if err := req.Attributes.Validate(); err != nil {
+			log.Info("invalid attributes", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error(err.Error()))
+			return
+		}
+
+		usr, err := attributesSetter.SetUserAttributes(r.Context(), userID, req.Attributes)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to set user attributes", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to set user attributes"))
+			return
+		}
+
+		log.Info("user attributes set", slog.Int64("user_id", userID), slog.Int("count", len(req.Attributes)))
+
+		render.JSON(w, r, SetAttributesResponse{
+			Response: response.OK(),
+			User:     usr,
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
+)
+
+type SetSegmentsRequest struct {
+	// Segments is the full list of the user's segments, an empty list removes all of them.
+	Segments []SegmentRequest `json:"segments" validate:"required,unique=Slug,dive"`
+	// Lenient skips unknown segments instead of rejecting the request.
+	Lenient bool `json:"lenient"`
+}
+
+type UserSegmentsSetter interface {
+	SetUserSegments(ctx context.Context, userID int64, segments []storage.SegmentToAdd, lenient bool) (*storage.ConfigureResult, error)
+}
+
+// NewUserSegmentsSetter handles the HTTP request for replacing user segments.
+//
+// @Summary Set user segments
+// @Description Make the given list the exact set of the user's explicit segments. Missing segments are added,
+// @Description segments not in the list are removed and delete_at of the others is updated if it differs.
+// @Description Memberships added automatically by percentage segments are kept unless listed, listed ones are
+// @Description removed by a later request without them.
+// @Description The changes are applied in one transaction and returned, repeating the request changes nothing.
+// @Description Unknown segments are rejected with 422 unless "lenient" is set, in which case they are ignored.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Param request body SetSegmentsRequest true "Request body"
+// @Success 200 {object} ConfigureSegmentsResponse
+// @Failure 400 {object} ConfigureSegmentsResponse
+// @Failure 401 {object} ConfigureSegmentsResponse
+// @Failure 403 {object} ConfigureSegmentsResponse
+// @Failure 404 {object} ConfigureSegmentsResponse
+// @Failure 422 {object} ConfigureSegmentsResponse
+// @Failure 500 {object} ConfigureSegmentsResponse
+// @Router /users/{user_id}/segments [put]
+func NewUserSegmentsSetter(log *slog.Logger, userSegmentsSetter UserSegmentsSetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.set-segments.NewUserSegmentsSetter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("invalid user_id", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		var req SetSegmentsRequest
+
+		err = render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		result, err := userSegmentsSetter.SetUserSegments(r.Context(), userID, segmentsToAdd(req.Segments), req.Lenient)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			log.Info("unknown segments", slog.Any("slugs", result.Unknown()))
+
+			render.Status(r, http.StatusUnprocessableEntity)
+			render.JSON(w, r, ConfigureSegmentsResponse{
+				Response:        response.Error("unknown segments, no changes applied"),
+				Rejected:        rejectedSegments(result.Rejected),
+				UnknownSegments: result.Unknown(),
+			})
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to set user segments", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to set user segments"))
+			return
+		}
+
+		log.Info("user segments set",
+			slog.Any("added", result.Added),
+			slog.Any("removed", result.Removed),
+			slog.Any("updated", result.Updated),
+			slog.Any("ignored", result.Ignored),
+		)
+
+		render.JSON(w, r, ConfigureSegmentsResponse{
+			Response: response.OK(),
+			Added:    result.Added,
+			Removed:  result.Removed,
+			Updated:  result.Updated,
+			Ignored:  result.Ignored,
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+type UpdateRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type UpdateResponse struct {
+	response.Response
+	User *user.User `json:"user,omitempty"`
+}
+
+type UserUpdater interface {
+	UpdateUser(ctx context.Context, id int64, name string) (*user.User, error)
+}
+
+// NewUserUpdater handles the HTTP request for renaming a user.
+//
+// @Summary Rename a user
+// @Description Change the name of a user.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user_id path int true "User ID"
+// @Param request body UpdateRequest true "Request body"
+// @Success 200 {object} UpdateResponse
+// @Failure 400 {object} UpdateResponse
+// @Failure 404 {object} UpdateResponse
+// @Failure 401 {object} UpdateResponse
+// @Failure 403 {object} UpdateResponse
+// @Failure 500 {object} UpdateResponse
+// @Router /users/{user_id} [patch]
+func NewUserUpdater(log *slog.Logger, userUpdater UserUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.update.NewUserUpdater"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+		if err != nil {
+			log.Info("failed to parse user_id")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid request"))
+			return
+		}
+
+		var req UpdateRequest
+
+		err = render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		usr, err := userUpdater.UpdateUser(r.Context(), userID, req.Name)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Info("user not found", slog.Int64("user_id", userID))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("user not found"))
+			return
+		}
+		if errors.Is(err, storage.ErrUserExists) {
+			log.Info("user already exists", slog.String("name", req.Name))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("user already exists"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to update user", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to update user"))
+			return
+		}
+
+		log.Info("user updated", slog.Int64("user_id", userID))
+
+		render.JSON(w, r, UpdateResponse{
+			Response: response.OK(),
+			User:     usr,
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/storage"
+)
+
+type DeleteResponse struct {
+	response.Response
+}
+
+type WebhookDeleter interface {
+	DeleteWebhook(ctx context.Context, id int64) error
+}
+
+// NewWebhookDeleter handles the HTTP request for deleting a webhook.
+//
+// @Summary Delete a webhook
+// @Description Delete a webhook together with its pending and failed deliveries.
+// @Tags webhooks
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} DeleteResponse
+// @Failure 400 {object} DeleteResponse
+// @Failure 401 {object} DeleteResponse
+// @Failure 403 {object} DeleteResponse
+// @Failure 404 {object} DeleteResponse
+// @Failure 500 {object} DeleteResponse
+// @Router /webhooks/{id} [delete]
+func NewWebhookDeleter(log *slog.Logger, webhookDeleter WebhookDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.webhooks.delete.NewWebhookDeleter"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Info("invalid webhook id", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("invalid webhook id"))
+			return
+		}
+
+		err = webhookDeleter.DeleteWebhook(r.Context(), id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			log.Info("webhook not found", slog.Int64("webhook_id", id))
+
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, response.Error("webhook not found"))
+			return
+		}
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to delete webhook", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to delete webhook"))
+			return
+		}
+
+		log.Info("webhook deleted", slog.Int64("webhook_id", id))
+
+		render.JSON(w, r, DeleteResponse{
+			Response: response.OK(),
+		})
+	}
+}
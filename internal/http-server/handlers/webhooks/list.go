@@ -0,0 +1,74 @@
+package webhooks
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/webhook"
+)
+
+type ListResponse struct {
+	Webhooks []*webhook.Webhook `json:"webhooks"`
+}
+
+type ListResponseFailed struct {
+	response.Response
+}
+
+type WebhookLister interface {
+	GetWebhooks(ctx context.Context) ([]*webhook.Webhook, error)
+}
+
+// NewWebhookLister handles the HTTP request for listing webhooks.
+//
+// @Summary List webhooks
+// @Description Retrieve all webhooks with the number of pending deliveries and of deliveries failed after all attempts.
+// @Description Secrets are never returned.
+// @Tags webhooks
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} ListResponse
+// @Failure 401 {object} ListResponseFailed
+// @Failure 403 {object} ListResponseFailed
+// @Failure 500 {object} ListResponseFailed
+// @Router /webhooks [get]
+func NewWebhookLister(log *slog.Logger, webhookLister WebhookLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.webhooks.list.NewWebhookLister"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		webhooks, err := webhookLister.GetWebhooks(r.Context())
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to get webhooks", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to get webhooks"))
+			return
+		}
+
+		log.Info("webhooks retrieved", slog.Int("count", len(webhooks)))
+
+		if webhooks == nil {
+			webhooks = []*webhook.Webhook{}
+		}
+
+		render.JSON(w, r, ListResponse{Webhooks: webhooks})
+	}
+}
@@ -0,0 +1,122 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/lib/secret"
+	"avito-test-task-2023/internal/models/webhook"
+)
+
+type SaveRequest struct {
+	URL string `json:"url" validate:"required,url,startswith=http"`
+}
+
+type SaveResponse struct {
+	response.Response
+	// Webhook includes the secret, it is only returned once.
+	Webhook *webhook.Webhook `json:"webhook,omitempty"`
+}
+
+type WebhookSaver interface {
+	SaveWebhook(ctx context.Context, url, secret string) (*webhook.Webhook, error)
+}
+
+// NewWebhookSaver handles the HTTP request for registering a webhook.
+//
+// @Summary Register a webhook
+// @Description Register a URL to receive changes of user segments: POST requests with a JSON event
+// @Description (user_segment.added, user_segment.removed or user_segment.updated) signed with the webhook secret.
+// @Description Only changes made after the registration are sent. The secret is returned only once, store it securely.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param request body SaveRequest true "Request body"
+// @Success 200 {object} SaveResponse
+// @Failure 400 {object} SaveResponse
+// @Failure 401 {object} SaveResponse
+// @Failure 403 {object} SaveResponse
+// @Failure 500 {object} SaveResponse
+// @Router /webhooks [post]
+func NewWebhookSaver(log *slog.Logger, webhookSaver WebhookSaver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.webhooks.save.NewWebhookSaver"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		var req SaveRequest
+
+		err := render.DecodeJSON(r.Body, &req)
+		if errors.Is(err, io.EOF) {
+			log.Error("request body is empty")
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("empty request"))
+			return
+		}
+		if err != nil {
+			log.Error("failed to decode request body", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.Error("failed to decode request"))
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validator.New().Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", sl.Err(err))
+
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, response.ValidationError(validateErr))
+			return
+		}
+
+		whSecret, err := secret.GenerateWebhookSecret()
+		if err != nil {
+			log.Error("failed to generate webhook secret", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to create webhook"))
+			return
+		}
+
+		wh, err := webhookSaver.SaveWebhook(r.Context(), req.URL, whSecret)
+		if status, resp, ok := response.ContextError(err); ok {
+			log.Info("request interrupted", sl.Err(err))
+
+			render.Status(r, status)
+			render.JSON(w, r, resp)
+			return
+		}
+		if err != nil {
+			log.Error("failed to save webhook", sl.Err(err))
+
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, response.Error("failed to create webhook"))
+			return
+		}
+
+		log.Info("webhook created", slog.Int64("webhook_id", wh.ID), slog.String("url", wh.URL))
+
+		render.JSON(w, r, SaveResponse{
+			Response: response.OK(),
+			Webhook:  wh,
+		})
+	}
+}
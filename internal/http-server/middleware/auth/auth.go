@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/lib/secret"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/storage"
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+type ctxKey struct{}
+
+type APIKeyGetter interface {
+	GetAPIKeyByHash(ctx context.Context, hash string) (*apikey.APIKey, error)
+}
+
+// New authenticates requests carrying an API key in the X-API-Key header
+// (or Authorization: Bearer) and puts the key into the request context.
+// Requests without a key pass through anonymously, so public routes keep working;
+// protected routes reject them with RequireRole.
+func New(log *slog.Logger, getter APIKeyGetter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log = log.With(
+			slog.String("component", "middleware/auth"),
+		)
+
+		log.Info("auth middleware enabled")
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := keyFromRequest(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			entry := log.With(
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+			)
+
+			apiKey, err := getter.GetAPIKeyByHash(r.Context(), secret.Hash(key))
+			if errors.Is(err, storage.ErrAPIKeyNotFound) {
+				entry.Info("unknown api key")
+
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.Error("invalid api key"))
+				return
+			}
+			if status, resp, ok := response.ContextError(err); ok {
+				entry.Info("request interrupted", sl.Err(err))
+
+				render.Status(r, status)
+				render.JSON(w, r, resp)
+				return
+			}
+			if err != nil {
+				entry.Error("failed to get api key", sl.Err(err))
+
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.Error("failed to authenticate"))
+				return
+			}
+
+			if apiKey.Revoked() {
+				entry.Info("revoked api key", slog.Int64("api_key_id", apiKey.ID))
+
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.Error("invalid api key"))
+				return
+			}
+
+			entry.Debug("api key authenticated",
+				slog.Int64("api_key_id", apiKey.ID),
+				slog.String("role", apiKey.Role),
+			)
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, apiKey)))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// RequireRole rejects requests which are not authenticated by New (401)
+// or whose API key role does not grant the required role (403).
+func RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			apiKey, ok := FromContext(r.Context())
+			if !ok {
+				render.Status(r, http.StatusUnauthorized)
+				render.JSON(w, r, response.Error("api key required"))
+				return
+			}
+
+			if !apiKey.Allows(role) {
+				render.Status(r, http.StatusForbidden)
+				render.JSON(w, r, response.Error("insufficient role: "+role+" required"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// AllowAll lets every request through. It replaces RequireRole when authentication is disabled.
+func AllowAll(string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return next
+	}
+}
+
+// FromContext returns the API key the request was authenticated with.
+func FromContext(ctx context.Context) (*apikey.APIKey, bool) {
+	apiKey, ok := ctx.Value(ctxKey{}).(*apikey.APIKey)
+	return apiKey, ok
+}
+
+func keyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return key
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
@@ -0,0 +1,204 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/http-server/middleware/auth"
+	"avito-test-task-2023/internal/lib/api/response"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/idempotency"
+	"avito-test-task-2023/internal/storage"
+)
+
+const (
+	HeaderKey = "Idempotency-Key"
+	// HeaderReplayed is set on responses replayed for a duplicate request.
+	HeaderReplayed = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+type Store interface {
+	ClaimIdempotencyKey(ctx context.Context, rec *idempotency.Record, lockTimeout time.Duration) (*idempotency.Record, error)
+	CompleteIdempotencyKey(ctx context.Context, rec *idempotency.Record, ttl time.Duration) error
+	DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string) error
+}
+
+// New makes POST, PUT, PATCH and DELETE requests with an Idempotency-Key header safe to retry.
+// The response of the first request is stored for cfg.TTL and replayed for requests with the same key.
+// The key may not be reused for a different request (422), and a duplicate of a request still in progress
+// is rejected (409) for at most cfg.LockTimeout. Server errors are not stored, so such requests may be retried.
+//
+// Keys are scoped by the API key, so New must follow the role check of the route: rejected requests are
+// not stored then. Requests without an API key are passed through, unless anonymous is set, which is only
+// safe when authentication is disabled and all callers share the keys.
+func New(log *slog.Logger, store Store, cfg config.Idempotency, anonymous bool) func(next http.Handler) http.Handler {
+	log = log.With(
+		slog.String("component", "middleware/idempotency"),
+	)
+
+	log.Info("idempotency middleware enabled", slog.String("ttl", cfg.TTL.String()))
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderKey)
+			if key == "" || !mutating(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			apiKey, authenticated := auth.FromContext(r.Context())
+			if !authenticated && !anonymous {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			entry := log.With(
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slog.String("idempotency_key", key),
+			)
+
+			if len(key) > maxKeyLength {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("idempotency key must be at most "+strconv.Itoa(maxKeyLength)+" characters"))
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBodySize))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				entry.Info("request body too large", slog.Int64("limit", maxBytesErr.Limit))
+
+				render.Status(r, http.StatusRequestEntityTooLarge)
+				render.JSON(w, r, response.Error("request body too large"))
+				return
+			}
+			if err != nil {
+				entry.Info("failed to read request body", sl.Err(err))
+
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, response.Error("failed to read request"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			rec := &idempotency.Record{Key: key, RequestHash: requestHash(r, body)}
+			if authenticated {
+				rec.APIKeyID = apiKey.ID
+			}
+
+			stored, err := store.ClaimIdempotencyKey(r.Context(), rec, cfg.LockTimeout)
+			if errors.Is(err, storage.ErrIdempotencyKeyExists) {
+				replay(w, r, entry, rec, stored)
+				return
+			}
+			if status, resp, ok := response.ContextError(err); ok {
+				entry.Info("request interrupted", sl.Err(err))
+
+				render.Status(r, status)
+				render.JSON(w, r, resp)
+				return
+			}
+			if err != nil {
+				entry.Error("failed to claim idempotency key", sl.Err(err))
+
+				render.Status(r, http.StatusInternalServerError)
+				render.JSON(w, r, response.Error("failed to check idempotency key"))
+				return
+			}
+
+			var buf bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&buf)
+
+			completed := false
+			defer func() {
+				// the request may have been canceled, the key is saved anyway
+				ctx := context.Background()
+
+				if completed {
+					if err := store.CompleteIdempotencyKey(ctx, rec, cfg.TTL); err != nil {
+						entry.Error("failed to save idempotent response", sl.Err(err))
+					}
+					return
+				}
+
+				// the handler failed or panicked, let the client retry
+				if err := store.DeleteIdempotencyKey(ctx, rec.APIKeyID, rec.Key); err != nil {
+					entry.Error("failed to release idempotency key", sl.Err(err))
+				}
+			}()
+
+			next.ServeHTTP(ww, r)
+
+			rec.StatusCode = ww.Status()
+			if rec.StatusCode == 0 {
+				rec.StatusCode = http.StatusOK
+			}
+			rec.ContentType = ww.Header().Get("Content-Type")
+			rec.Body = buf.Bytes()
+
+			completed = rec.StatusCode < http.StatusInternalServerError && rec.StatusCode != response.StatusClientClosedRequest
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func replay(w http.ResponseWriter, r *http.Request, log *slog.Logger, rec, stored *idempotency.Record) {
+	if stored.RequestHash != rec.RequestHash {
+		log.Info("idempotency key reused for another request")
+
+		render.Status(r, http.StatusUnprocessableEntity)
+		render.JSON(w, r, response.Error("idempotency key is already used for another request"))
+		return
+	}
+
+	if !stored.Completed() {
+		log.Info("duplicate of a request in progress")
+
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, response.Error("request with this idempotency key is in progress"))
+		return
+	}
+
+	log.Info("replaying idempotent response", slog.Int("status", stored.StatusCode))
+
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set(HeaderReplayed, "true")
+	w.WriteHeader(stored.StatusCode)
+	_, _ = w.Write(stored.Body)
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestHash identifies the request by its method, URL and body.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
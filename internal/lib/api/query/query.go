@@ -0,0 +1,21 @@
+package query
+
+import "strconv"
+
+// Int parses an integer query parameter, an empty value yields def.
+func Int(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// Bool parses a boolean query parameter, an empty value yields def.
+func Bool(value string, def bool) (bool, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.ParseBool(value)
+}
@@ -1,7 +1,10 @@
 package response
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
@@ -21,6 +24,10 @@ const (
 	StatusError = "Error"
 )
 
+// StatusClientClosedRequest is the non-standard HTTP status (introduced by nginx) for requests
+// the client canceled before the response was written.
+const StatusClientClosedRequest = 499
+
 func OK() Response {
 	return Response{
 		Status: StatusOK,
@@ -41,6 +48,14 @@ func ValidationError(errs validator.ValidationErrors) Response {
 		switch err.ActualTag() {
 		case "required":
 			errMsgs = append(errMsgs, fmt.Sprintf("field %s is a required field", err.Field()))
+		case "gte", "min":
+			errMsgs = append(errMsgs, fmt.Sprintf("field %s must be at least %s", err.Field(), err.Param()))
+		case "lte", "max":
+			errMsgs = append(errMsgs, fmt.Sprintf("field %s must be at most %s", err.Field(), err.Param()))
+		case "oneof":
+			errMsgs = append(errMsgs, fmt.Sprintf("field %s must be one of: %s", err.Field(), err.Param()))
+		case "unique":
+			errMsgs = append(errMsgs, fmt.Sprintf("field %s must not contain duplicates", err.Field()))
 		default:
 			errMsgs = append(errMsgs, fmt.Sprintf("field %s is not valid", err.Field()))
 		}
@@ -51,3 +66,16 @@ func ValidationError(errs validator.ValidationErrors) Response {
 		Error:  strings.Join(errMsgs, ", "),
 	}
 }
+
+// ContextError maps errors caused by a done context to an HTTP status and response:
+// 499 if the request was canceled (e.g. the client disconnected), 504 if a deadline was exceeded.
+func ContextError(err error) (int, Response, bool) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest, Error("request canceled"), true
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, Error("request timed out"), true
+	default:
+		return 0, Response{}, false
+	}
+}
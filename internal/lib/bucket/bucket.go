@@ -0,0 +1,25 @@
+package bucket
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// Buckets is the number of buckets users are spread across, so a bucket is one percent of users.
+const Buckets = 100
+
+// Of returns a stable bucket in [0, Buckets) for the user within the given key (e.g. segment slug).
+// The same key and user always land in the same bucket, and different keys spread users independently.
+func Of(key string, userID int64) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{':'})
+	_, _ = h.Write([]byte(strconv.FormatInt(userID, 10)))
+
+	return int(h.Sum32() % Buckets)
+}
+
+// Contains reports whether the user falls into the first percent buckets of the key.
+func Contains(key string, userID int64, percent int) bool {
+	return Of(key, userID) < percent
+}
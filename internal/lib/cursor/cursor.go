@@ -0,0 +1,35 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Encode returns an opaque pagination cursor holding v.
+func Encode(v any) (string, error) {
+	const op = "lib.cursor.Encode"
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Decode reads a cursor returned by Encode into v.
+func Decode(cursor string, v any) error {
+	const op = "lib.cursor.Decode"
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
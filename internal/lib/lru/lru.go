@@ -0,0 +1,89 @@
+package lru
+
+import (
+	"container/list"
+	"time"
+)
+
+// Cache keeps at most size entries for at most ttl, evicting the least recently used ones first.
+// It is not safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	size  int
+	ttl   time.Duration
+	order *list.List // front is the most recently used
+	items map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+func New[K comparable, V any](size int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[K]*list.Element, size),
+	}
+}
+
+// Get returns the value of the key unless it is missing or expired.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var zero V
+
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+
+	e := el.Value.(*entry[K, V])
+	if time.Now().After(e.expiresAt) {
+		c.removeElement(el)
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return e.value, true
+}
+
+// Add sets the value of the key, evicting the least recently used entry if the cache is full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	expiresAt := time.Now().Add(c.ttl)
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expiresAt = value, expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiresAt: expiresAt})
+
+	if c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *Cache[K, V]) Remove(key K) {
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Purge removes all entries.
+func (c *Cache[K, V]) Purge() {
+	c.order.Init()
+	c.items = make(map[K]*list.Element, c.size)
+}
+
+func (c *Cache[K, V]) Len() int {
+	return c.order.Len()
+}
+
+func (c *Cache[K, V]) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,69 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"avito-test-task-2023/internal/models/history"
+)
+
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+// PeriodLayout is the layout of a report period, a month.
+const PeriodLayout = "2006-01"
+
+// HistoryFileName returns the name of the history report of the user for the given period (YYYY-MM).
+func HistoryFileName(userID int64, period string) string {
+	return fmt.Sprintf("history_%d_%s.csv", userID, period)
+}
+
+// WriteHistoryCSV writes records to dir/name in the "user_id;segment;operation;datetime" format.
+// The file is written to a temporary location first, so readers never see a partial report.
+func WriteHistoryCSV(dir, name string, records []*history.Record) error {
+	const op = "lib.report.WriteHistoryCSV"
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := csv.NewWriter(tmp)
+	w.Comma = ';'
+
+	for _, rec := range records {
+		err := w.Write([]string{
+			strconv.FormatInt(rec.UserID, 10),
+			rec.Segment,
+			rec.Operation,
+			rec.CreatedAt.UTC().Format(dateTimeLayout),
+		})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package secret
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Prefixes make secrets recognizable, e.g. by secret scanners.
+const (
+	prefix        = "ask_"
+	webhookPrefix = "whsec_"
+)
+
+// GenerateAPIKey returns a new random API key.
+func GenerateAPIKey() (string, error) {
+	const op = "lib.secret.GenerateAPIKey"
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// GenerateWebhookSecret returns a new random secret for signing webhook requests.
+func GenerateWebhookSecret() (string, error) {
+	const op = "lib.secret.GenerateWebhookSecret"
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return webhookPrefix + hex.EncodeToString(b), nil
+}
+
+// Hash returns the hex encoded SHA-256 of the key. Only hashes of API keys are stored,
+// a plain SHA-256 is enough since the keys are random and long.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the service collectors. A nil *Metrics is valid and records nothing,
+// so components may be given one when metrics are disabled.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	ttlRuns     *prometheus.CounterVec
+	ttlDeleted  prometheus.Counter
+	ttlDuration prometheus.Histogram
+
+	cacheLookups       *prometheus.CounterVec
+	cacheInvalidations *prometheus.CounterVec
+
+	webhookDeliveries *prometheus.CounterVec
+	webhookDuration   prometheus.Histogram
+}
+
+// New creates the collectors with the given namespace and histogram buckets (in seconds)
+// and registers them together with the Go runtime and process collectors.
+func New(namespace string, buckets []float64) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests by method, route pattern and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "HTTP request latency by method, route pattern and status.",
+			Buckets:   buckets,
+		}, []string{"method", "route", "status"}),
+
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Storage operation latency by method.",
+			Buckets:   buckets,
+		}, []string{"method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_errors_total",
+			Help:      "Number of failed storage operations by method.",
+		}, []string{"method"}),
+
+		ttlRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ttl_sweeper",
+			Name:      "runs_total",
+			Help:      "Number of TTL sweeper runs by result.",
+		}, []string{"result"}),
+		ttlDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ttl_sweeper",
+			Name:      "rows_deleted_total",
+			Help:      "Number of expired user segments deleted by the TTL sweeper.",
+		}),
+		ttlDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ttl_sweeper",
+			Name:      "duration_seconds",
+			Help:      "TTL sweeper run duration.",
+			Buckets:   buckets,
+		}),
+
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "lookups_total",
+			Help:      "Number of cache lookups by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		cacheInvalidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "invalidations_total",
+			Help:      "Number of cache invalidations by cache and scope (keys or all).",
+		}, []string{"cache", "scope"}),
+
+		webhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "webhooks",
+			Name:      "deliveries_total",
+			Help:      "Number of webhook delivery attempts by result (delivered, retry or failed).",
+		}, []string{"result"}),
+		webhookDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "webhooks",
+			Name:      "delivery_duration_seconds",
+			Help:      "Webhook request latency.",
+			Buckets:   buckets,
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: namespace}),
+		m.httpRequests,
+		m.httpDuration,
+		m.storageDuration,
+		m.storageErrors,
+		m.ttlRuns,
+		m.ttlDeleted,
+		m.ttlDuration,
+		m.cacheLookups,
+		m.cacheInvalidations,
+		m.webhookDeliveries,
+		m.webhookDuration,
+	)
+
+	return m
+}
+
+// Handler serves the registered metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// RegisterDBStats exposes connection pool statistics of db.
+func (m *Metrics) RegisterDBStats(db *sql.DB, dbName string) {
+	if m == nil {
+		return
+	}
+
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+}
+
+func (m *Metrics) ObserveHTTPRequest(method, route, status string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.httpRequests.WithLabelValues(method, route, status).Inc()
+	m.httpDuration.WithLabelValues(method, route, status).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveStorageOperation(method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.storageDuration.WithLabelValues(method).Observe(duration.Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (m *Metrics) ObserveTTLSweep(deleted int64, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.ttlDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.ttlRuns.WithLabelValues("error").Inc()
+		return
+	}
+
+	m.ttlRuns.WithLabelValues("success").Inc()
+	m.ttlDeleted.Add(float64(deleted))
+}
+
+func (m *Metrics) ObserveCacheLookup(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func (m *Metrics) ObserveCacheInvalidation(cache string, all bool) {
+	if m == nil {
+		return
+	}
+
+	scope := "keys"
+	if all {
+		scope = "all"
+	}
+	m.cacheInvalidations.WithLabelValues(cache, scope).Inc()
+}
+
+func (m *Metrics) ObserveWebhookDelivery(result string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.webhookDeliveries.WithLabelValues(result).Inc()
+	m.webhookDuration.Observe(duration.Seconds())
+}
@@ -0,0 +1,44 @@
+package apikey
+
+import "time"
+
+// Roles are ordered, every role is granted the permissions of the previous ones:
+// reader < analyst < admin.
+const (
+	// RoleReader is meant for product services, which only read user segments.
+	RoleReader = "reader"
+	// RoleAnalyst may also manage users and configure their memberships.
+	RoleAnalyst = "analyst"
+	// RoleAdmin may also create and delete segments and manage API keys.
+	RoleAdmin = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleReader:  1,
+	RoleAnalyst: 2,
+	RoleAdmin:   3,
+}
+
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// Allows reports whether the key role grants the permissions of the required role.
+func (k *APIKey) Allows(required string) bool {
+	level, ok := roleLevels[k.Role]
+	return ok && level >= roleLevels[required]
+}
+
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
@@ -0,0 +1,56 @@
+package experiment
+
+import (
+	"time"
+
+	"avito-test-task-2023/internal/lib/bucket"
+)
+
+// Experiment splits users between variants by weight, e.g. AVITO_DISCOUNT_30 and AVITO_DISCOUNT_50
+// of one discount test, so every user gets at most one of them.
+type Experiment struct {
+	ID          int64  `json:"id,omitempty"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	// Segment limits the experiment to the users in the segment, everybody takes part if it is empty.
+	Segment   string    `json:"segment,omitempty"`
+	Variants  []Variant `json:"variants"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Variant gets Weight percent of the users taking part in the experiment.
+type Variant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Assignment is the variant a user got in an experiment.
+type Assignment struct {
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
+}
+
+// TotalWeight returns the share of users assigned to any variant, at most 100.
+func (e *Experiment) TotalWeight() int {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	return total
+}
+
+// Assign returns the variant of the user. Variants take consecutive buckets of the user hash in their order,
+// so a user keeps the variant as long as the weights are the same. It returns false for users in the buckets
+// left over by the weights. The hash differs from the one of a segment with the same slug.
+func (e *Experiment) Assign(userID int64) (string, bool) {
+	b := bucket.Of("experiment:"+e.Slug, userID)
+	for _, v := range e.Variants {
+		if b < v.Weight {
+			return v.Name, true
+		}
+		b -= v.Weight
+	}
+
+	return "", false
+}
@@ -0,0 +1,30 @@
+package history
+
+import "time"
+
+const (
+	OperationAdd    = "add"
+	OperationDelete = "delete"
+	// OperationUpdate is a change of delete_at of an existing membership.
+	OperationUpdate = "update"
+)
+
+const (
+	ReasonManual         = "manual"
+	ReasonAuto           = "auto"
+	ReasonTTL            = "ttl"
+	ReasonSegmentDeleted = "segment_deleted"
+	ReasonUserDeleted    = "user_deleted"
+	ReasonBulk           = "bulk"
+)
+
+type Record struct {
+	ID        int64  `json:"id,omitempty"`
+	UserID    int64  `json:"user_id"`
+	Segment   string `json:"segment"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+	// DeleteAt is the TTL of an added membership.
+	DeleteAt  *time.Time `json:"delete_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
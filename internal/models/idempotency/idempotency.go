@@ -0,0 +1,19 @@
+package idempotency
+
+// Record is the stored outcome of a request made with an Idempotency-Key.
+// Keys are scoped by the API key the request was authenticated with, 0 for anonymous requests.
+type Record struct {
+	APIKeyID int64
+	Key      string
+	// RequestHash identifies the request, a key may not be reused for another request.
+	RequestHash string
+
+	// StatusCode is 0 while the first request with the key is in progress.
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+func (r *Record) Completed() bool {
+	return r.StatusCode != 0
+}
@@ -0,0 +1,46 @@
+package job
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	TypeBulkEnroll      = "bulk_enroll"
+	TypeBulkRemove      = "bulk_remove"
+	TypePercentBackfill = "percent_backfill"
+	TypeHistoryReport   = "history_report"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+type Job struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	Status   string          `json:"status"`
+	Payload  json.RawMessage `json:"-" swaggerignore:"true"`
+	Progress Progress        `json:"progress"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error,omitempty"`
+	// Result is the job result, or the partial result saved while the job runs.
+	Result json.RawMessage `json:"result,omitempty" swaggertype:"object"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Progress is the number of processed items out of the total, the total is 0 until it is known.
+type Progress struct {
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
@@ -0,0 +1,31 @@
+package job
+
+import "time"
+
+type BulkEnrollPayload struct {
+	Slug  string     `json:"slug"`
+	Users []BulkUser `json:"users"`
+}
+
+// BulkUser is a user to add to a segment. If DeleteAt is set,
+// the user is removed from the segment at that time.
+type BulkUser struct {
+	UserID   int64      `json:"user_id"`
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+type BulkRemovePayload struct {
+	Slug    string  `json:"slug"`
+	UserIDs []int64 `json:"user_ids"`
+}
+
+type PercentBackfillPayload struct {
+	Slug string `json:"slug"`
+}
+
+type HistoryReportPayload struct {
+	UserID int64  `json:"user_id"`
+	Period string `json:"period"`
+	// Link is the URL the report is served at.
+	Link string `json:"link"`
+}
@@ -0,0 +1,192 @@
+package segment
+
+import (
+	"fmt"
+
+	"avito-test-task-2023/internal/models/user"
+)
+
+// Rule operators.
+const (
+	OperatorEq        = "eq"
+	OperatorNe        = "ne"
+	OperatorIn        = "in"
+	OperatorNotIn     = "not_in"
+	OperatorGt        = "gt"
+	OperatorGte       = "gte"
+	OperatorLt        = "lt"
+	OperatorLte       = "lte"
+	OperatorExists    = "exists"
+	OperatorNotExists = "not_exists"
+)
+
+const maxConditions = 20
+
+// Rule makes a segment dynamic: users whose attributes satisfy all of its conditions are in the segment
+// in addition to its explicit members. It is evaluated when user segments are read, so it follows
+// attribute changes right away and membership changes by rules are not kept in the history.
+type Rule []Condition
+
+// Condition compares an attribute with the value. A condition on an attribute the user does not have
+// is false, except not_exists. Values of different types are never equal, gt, gte, lt and lte
+// compare numbers with numbers and strings with strings.
+type Condition struct {
+	Attribute string `json:"attribute"`
+	Operator  string `json:"operator"`
+	// Value is a string, a number or a boolean, a non-empty list of them for in and not_in
+	// and is omitted for exists and not_exists.
+	Value any `json:"value,omitempty"`
+}
+
+// Validate checks the rule has at most 20 conditions and the values suit the operators.
+func (r Rule) Validate() error {
+	if len(r) > maxConditions {
+		return fmt.Errorf("rule must have at most %d conditions", maxConditions)
+	}
+
+	for i, c := range r {
+		if c.Attribute == "" {
+			return fmt.Errorf("rule condition %d: attribute is required", i)
+		}
+
+		switch c.Operator {
+		case OperatorEq, OperatorNe:
+			if !scalar(c.Value) {
+				return fmt.Errorf("rule condition %d: value must be a string, a number or a boolean", i)
+			}
+		case OperatorIn, OperatorNotIn:
+			values, ok := c.Value.([]any)
+			if !ok || len(values) == 0 {
+				return fmt.Errorf("rule condition %d: value must be a non-empty list", i)
+			}
+			for _, v := range values {
+				if !scalar(v) {
+					return fmt.Errorf("rule condition %d: values must be strings, numbers or booleans", i)
+				}
+			}
+		case OperatorGt, OperatorGte, OperatorLt, OperatorLte:
+			switch c.Value.(type) {
+			case string, float64:
+			default:
+				return fmt.Errorf("rule condition %d: value must be a string or a number", i)
+			}
+		case OperatorExists, OperatorNotExists:
+			if c.Value != nil {
+				return fmt.Errorf("rule condition %d: value must be omitted", i)
+			}
+		default:
+			return fmt.Errorf("rule condition %d: unknown operator %q", i, c.Operator)
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether the attributes satisfy every condition. An empty rule matches nobody.
+func (r Rule) Match(attrs user.Attributes) bool {
+	if len(r) == 0 {
+		return false
+	}
+
+	for _, c := range r {
+		if !c.match(attrs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c Condition) match(attrs user.Attributes) bool {
+	v, ok := attrs[c.Attribute]
+
+	switch c.Operator {
+	case OperatorExists:
+		return ok
+	case OperatorNotExists:
+		return !ok
+	}
+
+	if !ok {
+		return false
+	}
+
+	switch c.Operator {
+	case OperatorEq:
+		return v == c.Value
+	case OperatorNe:
+		return v != c.Value
+	case OperatorIn, OperatorNotIn:
+		values, _ := c.Value.([]any)
+		found := false
+		for _, want := range values {
+			if v == want {
+				found = true
+				break
+			}
+		}
+		return found == (c.Operator == OperatorIn)
+	case OperatorGt, OperatorGte, OperatorLt, OperatorLte:
+		cmp, ok := compare(v, c.Value)
+		if !ok {
+			return false
+		}
+
+		switch c.Operator {
+		case OperatorGt:
+			return cmp > 0
+		case OperatorGte:
+			return cmp >= 0
+		case OperatorLt:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	default:
+		return false
+	}
+}
+
+// compare returns -1, 0 or 1 if a is less than, equal to or greater than b,
+// and false if they are not both numbers or both strings.
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		default:
+			return 0, true
+		}
+	default:
+		return 0, false
+	}
+}
+
+func scalar(v any) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	default:
+		return false
+	}
+}
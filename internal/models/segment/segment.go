@@ -1,6 +1,62 @@
 package segment
 
+import "time"
+
+// Statuses describe the segment lifecycle, they do not affect memberships.
+const (
+	StatusActive   = "active"
+	StatusArchived = "archived"
+)
+
 type Segment struct {
-	ID   int64  `json:"id,omitempty"`
-	Slug string `json:"slug"`
+	ID          int64     `json:"id,omitempty"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"` // team responsible for the segment
+	Tags        []string  `json:"tags"`
+	Status      string    `json:"status"`
+	Percent     int       `json:"percent,omitempty"`
+	Rule        Rule      `json:"rule,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Params are the fields of a new segment set by clients, with the validation rules shared by the HTTP
+// and gRPC APIs: check them with the validator package and Rule.Validate.
+type Params struct {
+	Slug        string   `json:"slug" validate:"required"`
+	Description string   `json:"description"`
+	Owner       string   `json:"owner" validate:"max=255"`
+	Tags        []string `json:"tags" validate:"dive,required,max=64"`
+	Status      string   `json:"status" validate:"omitempty,oneof=active archived"`
+	Percent     int      `json:"percent" validate:"gte=0,lte=100"`
+	// Rule includes users by their attributes, see Rule.
+	Rule Rule `json:"rule,omitempty"`
+}
+
+// Segment returns a new segment with the params.
+func (p *Params) Segment() *Segment {
+	return &Segment{
+		Slug:        p.Slug,
+		Description: p.Description,
+		Owner:       p.Owner,
+		Tags:        p.Tags,
+		Status:      p.Status,
+		Percent:     p.Percent,
+		Rule:        p.Rule,
+	}
+}
+
+// Member is a user in a segment.
+type Member struct {
+	UserID   int64      `json:"user_id"`
+	Name     string     `json:"name"`
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+type Stats struct {
+	Slug    string `json:"slug"`
+	Members int64  `json:"members"`
+	// Expiring is the number of members with delete_at set.
+	Expiring int64 `json:"expiring"`
 }
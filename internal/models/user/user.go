@@ -1,6 +1,45 @@
 package user
 
+import "fmt"
+
+const (
+	maxAttributes      = 50
+	maxAttributeKey    = 64
+	maxAttributeLength = 255
+)
+
 type User struct {
-	ID   int64  `json:"id,omitempty"`
-	Name string `json:"name"`
+	ID         int64      `json:"id,omitempty"`
+	Name       string     `json:"name"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// Attributes are typed user properties matched by segment rules, e.g. {"city": "Moscow", "age": 30}.
+// Values are strings, numbers (float64, as decoded from JSON) or booleans.
+type Attributes map[string]any
+
+// Validate checks there are at most 50 attributes with keys of at most 64 characters
+// and scalar values, strings of at most 255 characters.
+func (a Attributes) Validate() error {
+	if len(a) > maxAttributes {
+		return fmt.Errorf("at most %d attributes are allowed", maxAttributes)
+	}
+
+	for key, value := range a {
+		if key == "" || len(key) > maxAttributeKey {
+			return fmt.Errorf("attribute names must be 1 to %d characters", maxAttributeKey)
+		}
+
+		switch v := value.(type) {
+		case string:
+			if len(v) > maxAttributeLength {
+				return fmt.Errorf("attribute %s must be at most %d characters", key, maxAttributeLength)
+			}
+		case float64, bool:
+		default:
+			return fmt.Errorf("attribute %s must be a string, a number or a boolean", key)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"time"
+
+	"avito-test-task-2023/internal/models/history"
+)
+
+// Event types, one per history operation.
+const (
+	EventSegmentAdded   = "user_segment.added"
+	EventSegmentRemoved = "user_segment.removed"
+	// EventSegmentUpdated is a change of delete_at of an existing membership.
+	EventSegmentUpdated = "user_segment.updated"
+)
+
+// Delivery statuses. Delivered deliveries are deleted, so only pending and failed ones are stored.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the deliveries, it is only returned on creation.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Pending and Failed count deliveries waiting for a (next) attempt and given up after all attempts.
+	Pending int64 `json:"pending"`
+	Failed  int64 `json:"failed"`
+}
+
+// Event is a change of a user's membership, it is the body of a webhook request.
+type Event struct {
+	// ID identifies the event across retries and webhooks.
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	UserID  int64  `json:"user_id"`
+	Segment string `json:"segment"`
+	// Reason is the history reason of the change, e.g. manual, ttl or segment_deleted.
+	Reason     string     `json:"reason"`
+	DeleteAt   *time.Time `json:"delete_at,omitempty"`
+	OccurredAt time.Time  `json:"occurred_at"`
+}
+
+// Delivery is an event to send to a webhook.
+type Delivery struct {
+	ID        int64
+	WebhookID int64
+	URL       string
+	Secret    string
+	EventID   int64
+	EventType string
+	// Payload is the JSON encoded Event.
+	Payload       []byte
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// EventType returns the type of events for the history operation.
+func EventType(operation string) string {
+	switch operation {
+	case history.OperationAdd:
+		return EventSegmentAdded
+	case history.OperationDelete:
+		return EventSegmentRemoved
+	default:
+		return EventSegmentUpdated
+	}
+}
@@ -0,0 +1,279 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/webhook"
+)
+
+// Headers of webhook requests.
+const (
+	// HeaderID is the event id, the same for all attempts, so receivers may drop duplicates.
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature is "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>", see Sign.
+	HeaderSignature = "X-Webhook-Signature"
+
+	userAgent = "avito-slug-webhooks"
+	// maxErrorLength limits the error saved with a delivery.
+	maxErrorLength = 512
+)
+
+// Delivery results in metrics.
+const (
+	resultDelivered = "delivered"
+	resultRetry     = "retry"
+	resultFailed    = "failed"
+)
+
+type Store interface {
+	FanOutOutboxEvents(ctx context.Context, limit int) (int, error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*webhook.Delivery, error)
+	FinishWebhookDelivery(ctx context.Context, d *webhook.Delivery) error
+}
+
+type DeliveryObserver interface {
+	ObserveWebhookDelivery(result string, duration time.Duration)
+}
+
+// Dispatcher sends outbox events to the registered webhooks.
+//
+// Events are written to the outbox in the transaction of the change, so none is lost, and every webhook
+// gets each event at least once: a delivery is retried with a growing delay until the webhook responds
+// with 2xx or MaxAttempts is reached. Several instances may run dispatchers, deliveries are claimed for Lease.
+type Dispatcher struct {
+	log      *slog.Logger
+	store    Store
+	client   *http.Client
+	cfg      config.Webhooks
+	observer DeliveryObserver
+}
+
+func NewDispatcher(log *slog.Logger, store Store, cfg config.Webhooks, observer DeliveryObserver) *Dispatcher {
+	return &Dispatcher{
+		log: log.With(
+			slog.String("component", "outbox/dispatcher"),
+		),
+		store: store,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			// a redirect is not a delivery
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cfg:      cfg,
+		observer: observer,
+	}
+}
+
+// Run dispatches events every PollInterval until ctx is done. Deliveries interrupted then are attempted again
+// after the restart.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.log.Info("webhook dispatcher started", slog.Int("workers", d.cfg.Workers))
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.log.Info("webhook dispatcher stopped")
+			return
+		case <-timer.C:
+		}
+
+		d.fanOut(ctx)
+
+		if d.dispatch(ctx) == d.cfg.BatchSize {
+			// there may be more due deliveries
+			timer.Reset(0)
+			continue
+		}
+
+		timer.Reset(d.cfg.PollInterval)
+	}
+}
+
+// fanOut turns all outbox events into deliveries.
+func (d *Dispatcher) fanOut(ctx context.Context) {
+	for {
+		moved, err := d.store.FanOutOutboxEvents(ctx, d.cfg.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.log.Error("failed to fan out outbox events", sl.Err(err))
+			}
+			return
+		}
+
+		if moved > 0 {
+			d.log.Debug("outbox events fanned out", slog.Int("events", moved))
+		}
+
+		if moved < d.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+// dispatch attempts a batch of due deliveries and returns its size.
+func (d *Dispatcher) dispatch(ctx context.Context) int {
+	deliveries, err := d.store.ClaimWebhookDeliveries(ctx, d.cfg.BatchSize, d.cfg.Lease)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.log.Error("failed to claim webhook deliveries", sl.Err(err))
+		}
+		return 0
+	}
+
+	sem := make(chan struct{}, d.cfg.Workers)
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(delivery *webhook.Delivery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries)
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *webhook.Delivery) {
+	log := d.log.With(
+		slog.Int64("delivery_id", delivery.ID),
+		slog.Int64("webhook_id", delivery.WebhookID),
+		slog.Int64("event_id", delivery.EventID),
+		slog.Int("attempt", delivery.Attempts),
+	)
+
+	t1 := time.Now()
+	err := d.send(ctx, delivery)
+	duration := time.Since(t1)
+
+	var result string
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// the service is stopping, the attempt does not count
+		delivery.Attempts--
+		delivery.NextAttemptAt = time.Now()
+		d.finish(log, delivery)
+		return
+	case err == nil:
+		result = resultDelivered
+		delivery.Status = webhook.DeliveryDelivered
+
+		log.Info("webhook delivered", slog.String("duration", duration.String()))
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		result = resultFailed
+		delivery.Status = webhook.DeliveryFailed
+		delivery.LastError = truncate(err.Error())
+
+		log.Error("webhook delivery failed, no attempts left", sl.Err(err))
+	default:
+		result = resultRetry
+		delivery.NextAttemptAt = time.Now().Add(d.backoff(delivery.Attempts))
+		delivery.LastError = truncate(err.Error())
+
+		log.Warn("webhook delivery failed, will retry", sl.Err(err), slog.Time("next_attempt_at", delivery.NextAttemptAt))
+	}
+
+	d.observer.ObserveWebhookDelivery(result, duration)
+
+	d.finish(log, delivery)
+}
+
+func (d *Dispatcher) finish(log *slog.Logger, delivery *webhook.Delivery) {
+	// the attempt is made, so it is saved even if the service is stopping
+	if err := d.store.FinishWebhookDelivery(context.Background(), delivery); err != nil {
+		log.Error("failed to finish webhook delivery", sl.Err(err))
+	}
+}
+
+// send posts the event to the webhook, any response but 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, delivery *webhook.Delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderID, strconv.FormatInt(delivery.EventID, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain some of the body, so the connection may be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the attempt following the given one: MinBackoff doubled with every attempt,
+// at most MaxBackoff, minus up to a half at random, so failed deliveries are not retried all at once.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.cfg.MinBackoff
+	for i := 1; i < attempt && delay < d.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.cfg.MaxBackoff {
+		delay = d.cfg.MaxBackoff
+	}
+
+	if half := int64(delay / 2); half > 0 {
+		delay -= time.Duration(rand.Int63n(half))
+	}
+
+	return delay
+}
+
+// Sign returns the signature of a webhook request: "sha256=" followed by the hex HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the webhook secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+
+	return s
+}
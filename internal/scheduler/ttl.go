@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"avito-test-task-2023/internal/lib/logger/sl"
+)
+
+type TTLDeleter interface {
+	DeleteSegmentsTTL(ctx context.Context) (int64, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+type SweepObserver interface {
+	ObserveTTLSweep(deleted int64, duration time.Duration, err error)
+}
+
+// TTLScheduler periodically removes users from segments whose delete_at has passed
+// and expired idempotency keys.
+type TTLScheduler struct {
+	log      *slog.Logger
+	deleter  TTLDeleter
+	interval time.Duration
+	observer SweepObserver
+
+	// lastRun is the unix nano time of the last successful sweep
+	lastRun atomic.Int64
+}
+
+func NewTTLScheduler(
+	log *slog.Logger, deleter TTLDeleter, interval time.Duration, observer SweepObserver,
+) *TTLScheduler {
+	return &TTLScheduler{
+		log: log.With(
+			slog.String("component", "scheduler/ttl"),
+		),
+		deleter:  deleter,
+		interval: interval,
+		observer: observer,
+	}
+}
+
+// Run deletes expired user segments and idempotency keys right away and then every interval until ctx is done.
+func (s *TTLScheduler) Run(ctx context.Context) {
+	s.log.Info("delete scheduler started (segments TTL)", slog.String("interval", s.interval.String()))
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep(ctx)
+		s.sweepIdempotencyKeys(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.log.Info("delete scheduler stopped (segments TTL)")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *TTLScheduler) sweep(ctx context.Context) {
+	t1 := time.Now()
+	deleted, err := s.deleter.DeleteSegmentsTTL(ctx)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s.observer.ObserveTTLSweep(deleted, time.Since(t1), err)
+
+	if err != nil {
+		s.log.Error("failed to delete segments (segments TTL)", sl.Err(err))
+		return
+	}
+
+	s.lastRun.Store(time.Now().UnixNano())
+
+	s.log.Info("TTL scheduler", slog.Int64("rows_deleted", deleted))
+}
+
+func (s *TTLScheduler) sweepIdempotencyKeys(ctx context.Context) {
+	deleted, err := s.deleter.DeleteExpiredIdempotencyKeys(ctx)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to delete expired idempotency keys", sl.Err(err))
+		return
+	}
+
+	if deleted > 0 {
+		s.log.Info("expired idempotency keys deleted", slog.Int64("keys_deleted", deleted))
+	}
+}
+
+// LastRun returns the time of the last successful sweep, zero if there was none.
+func (s *TTLScheduler) LastRun() time.Time {
+	lastRun := s.lastRun.Load()
+	if lastRun == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, lastRun)
+}
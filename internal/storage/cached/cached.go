@@ -0,0 +1,207 @@
+package cached
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"avito-test-task-2023/internal/lib/lru"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+// userSegmentsCache names the cache in metrics.
+const userSegmentsCache = "user_segments"
+
+type CacheObserver interface {
+	ObserveCacheLookup(cache string, hit bool)
+	ObserveCacheInvalidation(cache string, all bool)
+}
+
+// Storage caches user segments in front of the wrapped storage, the other operations are passed through.
+//
+// Changes made through this instance drop the affected entries right away. Changes made by other instances
+// are dropped on notifications from the database (see postgres.UserSegmentsListener), and entries expire
+// after ttl in any case, so segments stay actual within ttl even if notifications are lost.
+type Storage struct {
+	storage.Storage
+
+	observer CacheObserver
+
+	mu    sync.Mutex
+	cache *lru.Cache[int64, []*segment.Segment]
+	// generation is incremented by every invalidation, so segments read before it are not cached after it
+	generation uint64
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// New caches segments of at most size users for at most ttl.
+func New(next storage.Storage, size int, ttl time.Duration, observer CacheObserver) *Storage {
+	return &Storage{
+		Storage:  next,
+		observer: observer,
+		cache:    lru.New[int64, []*segment.Segment](size, ttl),
+	}
+}
+
+func (s *Storage) GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error) {
+	s.mu.Lock()
+	segments, ok := s.cache.Get(userID)
+	generation := s.generation
+	s.mu.Unlock()
+
+	s.observer.ObserveCacheLookup(userSegmentsCache, ok)
+
+	if ok {
+		return copySegments(segments), nil
+	}
+
+	segments, err := s.Storage.GetUserSegments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.generation == generation {
+		s.cache.Add(userID, copySegments(segments))
+	}
+	s.mu.Unlock()
+
+	return segments, nil
+}
+
+// InvalidateUserSegments drops cached segments of the users.
+func (s *Storage) InvalidateUserSegments(userIDs ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	for _, id := range userIDs {
+		s.cache.Remove(id)
+	}
+
+	s.observer.ObserveCacheInvalidation(userSegmentsCache, false)
+}
+
+// InvalidateAllUserSegments drops all cached segments.
+func (s *Storage) InvalidateAllUserSegments() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	s.cache.Purge()
+
+	s.observer.ObserveCacheInvalidation(userSegmentsCache, true)
+}
+
+// SaveUser may enroll the user into percentage segments and segments with rules.
+func (s *Storage) SaveUser(ctx context.Context, name string, attrs user.Attributes) (*user.User, error) {
+	usr, err := s.Storage.SaveUser(ctx, name, attrs)
+	if err == nil {
+		s.InvalidateUserSegments(usr.ID)
+	}
+
+	return usr, err
+}
+
+// SetUserAttributes changes the segments whose rules match the user.
+func (s *Storage) SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (*user.User, error) {
+	defer s.InvalidateUserSegments(id)
+	return s.Storage.SetUserAttributes(ctx, id, attrs)
+}
+
+func (s *Storage) DeleteUser(ctx context.Context, userID int64) error {
+	defer s.InvalidateUserSegments(userID)
+	return s.Storage.DeleteUser(ctx, userID)
+}
+
+func (s *Storage) SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error) {
+	if seg.Percent > 0 || len(seg.Rule) > 0 {
+		defer s.InvalidateAllUserSegments()
+	}
+	return s.Storage.SaveSegment(ctx, seg)
+}
+
+// SaveSegmentAsync leaves enrolling to BackfillSegmentPercent, only rules take effect right away.
+func (s *Storage) SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (*job.Job, error) {
+	if len(seg.Rule) > 0 {
+		defer s.InvalidateAllUserSegments()
+	}
+	return s.Storage.SaveSegmentAsync(ctx, seg)
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, slug string, upd storage.SegmentUpdate) (*segment.Segment, error) {
+	defer s.InvalidateAllUserSegments()
+	return s.Storage.UpdateSegment(ctx, slug, upd)
+}
+
+func (s *Storage) DeleteSegmentBySlug(ctx context.Context, slug string) error {
+	defer s.InvalidateAllUserSegments()
+	return s.Storage.DeleteSegmentBySlug(ctx, slug)
+}
+
+func (s *Storage) AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (*storage.BulkResult, error) {
+	userIDs := make([]int64, 0, len(members))
+	for _, m := range members {
+		userIDs = append(userIDs, m.UserID)
+	}
+
+	defer s.InvalidateUserSegments(userIDs...)
+	return s.Storage.AddSegmentUsers(ctx, slug, members)
+}
+
+func (s *Storage) RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*storage.BulkResult, error) {
+	defer s.InvalidateUserSegments(userIDs...)
+	return s.Storage.RemoveSegmentUsers(ctx, slug, userIDs)
+}
+
+// BackfillSegmentPercent enrolls users of a whole page, which are not known in advance.
+func (s *Storage) BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (*storage.BackfillPage, error) {
+	page, err := s.Storage.BackfillSegmentPercent(ctx, slug, afterUserID, limit)
+	if err == nil && page.Enrolled > 0 {
+		s.InvalidateAllUserSegments()
+	}
+
+	return page, err
+}
+
+func (s *Storage) ConfigureUserSegments(
+	ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool,
+) (*storage.ConfigureResult, error) {
+	defer s.InvalidateUserSegments(userID)
+	return s.Storage.ConfigureUserSegments(ctx, userID, segAdd, segDel, lenient)
+}
+
+func (s *Storage) SetUserSegments(
+	ctx context.Context, userID int64, segments []storage.SegmentToAdd, lenient bool,
+) (*storage.ConfigureResult, error) {
+	defer s.InvalidateUserSegments(userID)
+	return s.Storage.SetUserSegments(ctx, userID, segments, lenient)
+}
+
+func (s *Storage) DeleteSegmentsTTL(ctx context.Context) (int64, error) {
+	deleted, err := s.Storage.DeleteSegmentsTTL(ctx)
+	if deleted > 0 {
+		s.InvalidateAllUserSegments()
+	}
+
+	return deleted, err
+}
+
+func copySegments(segments []*segment.Segment) []*segment.Segment {
+	if segments == nil {
+		return nil
+	}
+
+	out := make([]*segment.Segment, 0, len(segments))
+	for _, seg := range segments {
+		cp := *seg
+		cp.Tags = append([]string(nil), seg.Tags...)
+		out = append(out, &cp)
+	}
+
+	return out
+}
@@ -0,0 +1,285 @@
+package instrumented
+
+import (
+	"context"
+	"time"
+
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/idempotency"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/models/webhook"
+	"avito-test-task-2023/internal/storage"
+)
+
+type OperationObserver interface {
+	ObserveStorageOperation(method string, duration time.Duration, err error)
+}
+
+// Storage reports latency and errors of every operation of the wrapped storage.
+type Storage struct {
+	next     storage.Storage
+	observer OperationObserver
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func New(next storage.Storage, observer OperationObserver) *Storage {
+	return &Storage{
+		next:     next,
+		observer: observer,
+	}
+}
+
+func (s *Storage) observe(method string, start time.Time, err *error) {
+	s.observer.ObserveStorageOperation(method, time.Since(start), *err)
+}
+
+func (s *Storage) SaveUser(ctx context.Context, name string, attrs user.Attributes) (_ *user.User, err error) {
+	defer s.observe("SaveUser", time.Now(), &err)
+	return s.next.SaveUser(ctx, name, attrs)
+}
+
+func (s *Storage) GetUser(ctx context.Context, id int64) (_ *user.User, err error) {
+	defer s.observe("GetUser", time.Now(), &err)
+	return s.next.GetUser(ctx, id)
+}
+
+func (s *Storage) GetUsers(ctx context.Context, limit, offset int, name string) (_ []*user.User, _ int64, err error) {
+	defer s.observe("GetUsers", time.Now(), &err)
+	return s.next.GetUsers(ctx, limit, offset, name)
+}
+
+func (s *Storage) UpdateUser(ctx context.Context, id int64, name string) (_ *user.User, err error) {
+	defer s.observe("UpdateUser", time.Now(), &err)
+	return s.next.UpdateUser(ctx, id, name)
+}
+
+func (s *Storage) SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (_ *user.User, err error) {
+	defer s.observe("SetUserAttributes", time.Now(), &err)
+	return s.next.SetUserAttributes(ctx, id, attrs)
+}
+
+func (s *Storage) DeleteUser(ctx context.Context, userID int64) (err error) {
+	defer s.observe("DeleteUser", time.Now(), &err)
+	return s.next.DeleteUser(ctx, userID)
+}
+
+func (s *Storage) SaveSegment(ctx context.Context, seg *segment.Segment) (_ int64, err error) {
+	defer s.observe("SaveSegment", time.Now(), &err)
+	return s.next.SaveSegment(ctx, seg)
+}
+
+func (s *Storage) SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (_ *job.Job, err error) {
+	defer s.observe("SaveSegmentAsync", time.Now(), &err)
+	return s.next.SaveSegmentAsync(ctx, seg)
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, slug string, upd storage.SegmentUpdate) (_ *segment.Segment, err error) {
+	defer s.observe("UpdateSegment", time.Now(), &err)
+	return s.next.UpdateSegment(ctx, slug, upd)
+}
+
+func (s *Storage) GetSegmentBySlug(ctx context.Context, slug string) (_ *segment.Segment, err error) {
+	defer s.observe("GetSegmentBySlug", time.Now(), &err)
+	return s.next.GetSegmentBySlug(ctx, slug)
+}
+
+func (s *Storage) GetSegments(ctx context.Context, filter storage.SegmentFilter) (_ []*segment.Segment, _ int64, err error) {
+	defer s.observe("GetSegments", time.Now(), &err)
+	return s.next.GetSegments(ctx, filter)
+}
+
+func (s *Storage) DeleteSegmentBySlug(ctx context.Context, slug string) (err error) {
+	defer s.observe("DeleteSegmentBySlug", time.Now(), &err)
+	return s.next.DeleteSegmentBySlug(ctx, slug)
+}
+
+func (s *Storage) GetSegmentMembers(ctx context.Context, slug string, filter storage.MemberFilter) (_ []*segment.Member, err error) {
+	defer s.observe("GetSegmentMembers", time.Now(), &err)
+	return s.next.GetSegmentMembers(ctx, slug, filter)
+}
+
+func (s *Storage) GetSegmentStats(ctx context.Context, slug string) (_ *segment.Stats, err error) {
+	defer s.observe("GetSegmentStats", time.Now(), &err)
+	return s.next.GetSegmentStats(ctx, slug)
+}
+
+func (s *Storage) AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (_ *storage.BulkResult, err error) {
+	defer s.observe("AddSegmentUsers", time.Now(), &err)
+	return s.next.AddSegmentUsers(ctx, slug, members)
+}
+
+func (s *Storage) RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (_ *storage.BulkResult, err error) {
+	defer s.observe("RemoveSegmentUsers", time.Now(), &err)
+	return s.next.RemoveSegmentUsers(ctx, slug, userIDs)
+}
+
+func (s *Storage) BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (_ *storage.BackfillPage, err error) {
+	defer s.observe("BackfillSegmentPercent", time.Now(), &err)
+	return s.next.BackfillSegmentPercent(ctx, slug, afterUserID, limit)
+}
+
+func (s *Storage) GetUserSegments(ctx context.Context, userID int64) (_ []*segment.Segment, err error) {
+	defer s.observe("GetUserSegments", time.Now(), &err)
+	return s.next.GetUserSegments(ctx, userID)
+}
+
+func (s *Storage) GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) (_ []string, err error) {
+	defer s.observe("GetUserSegmentsAt", time.Now(), &err)
+	return s.next.GetUserSegmentsAt(ctx, userID, at)
+}
+
+func (s *Storage) ConfigureUserSegments(
+	ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool,
+) (_ *storage.ConfigureResult, err error) {
+	defer s.observe("ConfigureUserSegments", time.Now(), &err)
+	return s.next.ConfigureUserSegments(ctx, userID, segAdd, segDel, lenient)
+}
+
+func (s *Storage) SetUserSegments(
+	ctx context.Context, userID int64, segments []storage.SegmentToAdd, lenient bool,
+) (_ *storage.ConfigureResult, err error) {
+	defer s.observe("SetUserSegments", time.Now(), &err)
+	return s.next.SetUserSegments(ctx, userID, segments, lenient)
+}
+
+func (s *Storage) DeleteSegmentsTTL(ctx context.Context) (_ int64, err error) {
+	defer s.observe("DeleteSegmentsTTL", time.Now(), &err)
+	return s.next.DeleteSegmentsTTL(ctx)
+}
+
+func (s *Storage) GetUserHistory(ctx context.Context, userID int64, from, to time.Time) (_ []*history.Record, err error) {
+	defer s.observe("GetUserHistory", time.Now(), &err)
+	return s.next.GetUserHistory(ctx, userID, from, to)
+}
+
+func (s *Storage) SaveAPIKey(ctx context.Context, name, role, hash string) (_ *apikey.APIKey, err error) {
+	defer s.observe("SaveAPIKey", time.Now(), &err)
+	return s.next.SaveAPIKey(ctx, name, role, hash)
+}
+
+func (s *Storage) GetAPIKeyByHash(ctx context.Context, hash string) (_ *apikey.APIKey, err error) {
+	defer s.observe("GetAPIKeyByHash", time.Now(), &err)
+	return s.next.GetAPIKeyByHash(ctx, hash)
+}
+
+func (s *Storage) GetAPIKeys(ctx context.Context) (_ []*apikey.APIKey, err error) {
+	defer s.observe("GetAPIKeys", time.Now(), &err)
+	return s.next.GetAPIKeys(ctx)
+}
+
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) (err error) {
+	defer s.observe("RevokeAPIKey", time.Now(), &err)
+	return s.next.RevokeAPIKey(ctx, id)
+}
+
+func (s *Storage) EnqueueJob(ctx context.Context, typ string, payload []byte) (_ *job.Job, err error) {
+	defer s.observe("EnqueueJob", time.Now(), &err)
+	return s.next.EnqueueJob(ctx, typ, payload)
+}
+
+func (s *Storage) GetJob(ctx context.Context, id int64) (_ *job.Job, err error) {
+	defer s.observe("GetJob", time.Now(), &err)
+	return s.next.GetJob(ctx, id)
+}
+
+func (s *Storage) ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (_ *job.Job, err error) {
+	defer s.observe("ClaimJob", time.Now(), &err)
+	return s.next.ClaimJob(ctx, lease, maxAttempts)
+}
+
+func (s *Storage) UpdateJobProgress(ctx context.Context, j *job.Job, lease time.Duration) (err error) {
+	defer s.observe("UpdateJobProgress", time.Now(), &err)
+	return s.next.UpdateJobProgress(ctx, j, lease)
+}
+
+func (s *Storage) FinishJob(ctx context.Context, j *job.Job) (err error) {
+	defer s.observe("FinishJob", time.Now(), &err)
+	return s.next.FinishJob(ctx, j)
+}
+
+func (s *Storage) ReleaseJob(ctx context.Context, j *job.Job) (err error) {
+	defer s.observe("ReleaseJob", time.Now(), &err)
+	return s.next.ReleaseJob(ctx, j)
+}
+
+func (s *Storage) ClaimIdempotencyKey(
+	ctx context.Context, rec *idempotency.Record, lockTimeout time.Duration,
+) (_ *idempotency.Record, err error) {
+	defer s.observe("ClaimIdempotencyKey", time.Now(), &err)
+	return s.next.ClaimIdempotencyKey(ctx, rec, lockTimeout)
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (_ int64, err error) {
+	defer s.observe("DeleteExpiredIdempotencyKeys", time.Now(), &err)
+	return s.next.DeleteExpiredIdempotencyKeys(ctx)
+}
+
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, rec *idempotency.Record, ttl time.Duration) (err error) {
+	defer s.observe("CompleteIdempotencyKey", time.Now(), &err)
+	return s.next.CompleteIdempotencyKey(ctx, rec, ttl)
+}
+
+func (s *Storage) DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string) (err error) {
+	defer s.observe("DeleteIdempotencyKey", time.Now(), &err)
+	return s.next.DeleteIdempotencyKey(ctx, apiKeyID, key)
+}
+
+func (s *Storage) SaveWebhook(ctx context.Context, url, secret string) (_ *webhook.Webhook, err error) {
+	defer s.observe("SaveWebhook", time.Now(), &err)
+	return s.next.SaveWebhook(ctx, url, secret)
+}
+
+func (s *Storage) GetWebhooks(ctx context.Context) (_ []*webhook.Webhook, err error) {
+	defer s.observe("GetWebhooks", time.Now(), &err)
+	return s.next.GetWebhooks(ctx)
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) (err error) {
+	defer s.observe("DeleteWebhook", time.Now(), &err)
+	return s.next.DeleteWebhook(ctx, id)
+}
+
+func (s *Storage) FanOutOutboxEvents(ctx context.Context, limit int) (_ int, err error) {
+	defer s.observe("FanOutOutboxEvents", time.Now(), &err)
+	return s.next.FanOutOutboxEvents(ctx, limit)
+}
+
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (_ []*webhook.Delivery, err error) {
+	defer s.observe("ClaimWebhookDeliveries", time.Now(), &err)
+	return s.next.ClaimWebhookDeliveries(ctx, limit, lease)
+}
+
+func (s *Storage) FinishWebhookDelivery(ctx context.Context, d *webhook.Delivery) (err error) {
+	defer s.observe("FinishWebhookDelivery", time.Now(), &err)
+	return s.next.FinishWebhookDelivery(ctx, d)
+}
+
+func (s *Storage) SaveExperiment(ctx context.Context, exp *experiment.Experiment) (err error) {
+	defer s.observe("SaveExperiment", time.Now(), &err)
+	return s.next.SaveExperiment(ctx, exp)
+}
+
+func (s *Storage) GetExperiments(ctx context.Context) (_ []*experiment.Experiment, err error) {
+	defer s.observe("GetExperiments", time.Now(), &err)
+	return s.next.GetExperiments(ctx)
+}
+
+func (s *Storage) DeleteExperiment(ctx context.Context, slug string) (err error) {
+	defer s.observe("DeleteExperiment", time.Now(), &err)
+	return s.next.DeleteExperiment(ctx, slug)
+}
+
+func (s *Storage) Ping(ctx context.Context) (err error) {
+	defer s.observe("Ping", time.Now(), &err)
+	return s.next.Ping(ctx)
+}
+
+func (s *Storage) Close() (err error) {
+	defer s.observe("Close", time.Now(), &err)
+	return s.next.Close()
+}
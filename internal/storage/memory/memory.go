@@ -0,0 +1,1756 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"avito-test-task-2023/internal/lib/bucket"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/idempotency"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/models/webhook"
+	"avito-test-task-2023/internal/storage"
+)
+
+// Storage keeps all data in process memory. It is safe for concurrent use
+// and loses everything on restart, so it is meant for local runs and tests.
+type Storage struct {
+	mu sync.RWMutex
+
+	users    map[int64]*user.User
+	segments map[int64]*segment.Segment
+	// slugs maps segment slug to segment id
+	slugs map[string]int64
+	// memberships maps user id to segment id to membership
+	memberships map[int64]map[int64]*membership
+	history     []*history.Record
+	apiKeys     map[int64]*apikey.APIKey
+	// apiKeyHashes maps API key hash to API key id
+	apiKeyHashes map[string]int64
+	jobs         map[int64]*storedJob
+	idempotency  map[idempotencyKey]*storedIdempotencyRecord
+	webhooks     map[int64]*webhook.Webhook
+	// outbox holds events of history records until they are fanned out to deliveries
+	outbox      []*webhook.Event
+	deliveries  map[int64]*storedDelivery
+	experiments map[int64]*experiment.Experiment
+
+	lastUserID       int64
+	lastSegmentID    int64
+	lastHistoryID    int64
+	lastAPIKeyID     int64
+	lastJobID        int64
+	lastWebhookID    int64
+	lastDeliveryID   int64
+	lastExperimentID int64
+}
+
+type membership struct {
+	deleteAt *time.Time
+	// source is the history reason the membership was added with: manual, auto or bulk.
+	source string
+}
+
+type idempotencyKey struct {
+	apiKeyID int64
+	key      string
+}
+
+type storedIdempotencyRecord struct {
+	idempotency.Record
+	expiresAt time.Time
+}
+
+type storedDelivery struct {
+	webhook.Delivery
+	lockedUntil time.Time
+}
+
+type storedJob struct {
+	job.Job
+	lockedUntil time.Time
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func New() *Storage {
+	return &Storage{
+		users:        make(map[int64]*user.User),
+		segments:     make(map[int64]*segment.Segment),
+		slugs:        make(map[string]int64),
+		memberships:  make(map[int64]map[int64]*membership),
+		apiKeys:      make(map[int64]*apikey.APIKey),
+		apiKeyHashes: make(map[string]int64),
+		jobs:         make(map[int64]*storedJob),
+		idempotency:  make(map[idempotencyKey]*storedIdempotencyRecord),
+		webhooks:     make(map[int64]*webhook.Webhook),
+		deliveries:   make(map[int64]*storedDelivery),
+		experiments:  make(map[int64]*experiment.Experiment),
+	}
+}
+
+// SaveUser creates a user and enrolls them into every percentage segment whose share they fall into.
+func (s *Storage) SaveUser(ctx context.Context, name string, attrs user.Attributes) (*user.User, error) {
+	const op = "storage.memory.SaveUser"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, usr := range s.users {
+		if usr.Name == name {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+	}
+
+	s.lastUserID++
+	usr := &user.User{ID: s.lastUserID, Name: name, Attributes: copyAttributes(attrs)}
+	s.users[usr.ID] = usr
+	s.memberships[usr.ID] = make(map[int64]*membership)
+
+	for _, seg := range s.segments {
+		if seg.Percent > 0 && bucket.Contains(seg.Slug, usr.ID, seg.Percent) {
+			s.addMembership(usr.ID, seg, nil, history.ReasonAuto)
+		}
+	}
+
+	return copyUser(usr), nil
+}
+
+func (s *Storage) GetUser(ctx context.Context, id int64) (*user.User, error) {
+	const op = "storage.memory.GetUser"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usr, ok := s.users[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return copyUser(usr), nil
+}
+
+// GetUsers returns a page of users ordered by id whose name contains the given substring
+// (all users if it is empty), and the total number of matching users.
+func (s *Storage) GetUsers(ctx context.Context, limit, offset int, name string) ([]*user.User, int64, error) {
+	const op = "storage.memory.GetUsers"
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name = strings.ToLower(name)
+
+	var matched []*user.User
+	for _, usr := range s.users {
+		if strings.Contains(strings.ToLower(usr.Name), name) {
+			matched = append(matched, usr)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+
+	total := int64(len(matched))
+
+	users := make([]*user.User, 0, limit)
+	for i := offset; i < len(matched) && len(users) < limit; i++ {
+		users = append(users, copyUser(matched[i]))
+	}
+
+	return users, total, nil
+}
+
+func (s *Storage) UpdateUser(ctx context.Context, id int64, name string) (*user.User, error) {
+	const op = "storage.memory.UpdateUser"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usr, ok := s.users[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	for _, other := range s.users {
+		if other.ID != id && other.Name == name {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+	}
+
+	usr.Name = name
+
+	return copyUser(usr), nil
+}
+
+func (s *Storage) SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (*user.User, error) {
+	const op = "storage.memory.SetUserAttributes"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usr, ok := s.users[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	usr.Attributes = copyAttributes(attrs)
+
+	return copyUser(usr), nil
+}
+
+func (s *Storage) DeleteUser(ctx context.Context, userID int64) error {
+	const op = "storage.memory.DeleteUser"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotExists)
+	}
+
+	for segmentID := range s.memberships[userID] {
+		s.deleteMembership(userID, s.segments[segmentID], history.ReasonUserDeleted)
+	}
+
+	delete(s.memberships, userID)
+	delete(s.users, userID)
+
+	return nil
+}
+
+// SaveSegment creates a segment. If percent is positive, the matching share of existing users
+// is enrolled into it right away; users created later are enrolled by SaveUser.
+// It returns the number of users enrolled.
+func (s *Storage) SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error) {
+	const op = "storage.memory.SaveSegment"
+
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.saveSegment(seg)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var enrolled int64
+	if stored.Percent > 0 {
+		for userID := range s.users {
+			if bucket.Contains(stored.Slug, userID, stored.Percent) {
+				s.addMembership(userID, stored, nil, history.ReasonAuto)
+				enrolled++
+			}
+		}
+	}
+
+	return enrolled, nil
+}
+
+func (s *Storage) SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (*job.Job, error) {
+	const op = "storage.memory.SaveSegmentAsync"
+
+	payload, err := json.Marshal(job.PercentBackfillPayload{Slug: seg.Slug})
+	if err != nil {
+		return nil, fmt.Errorf("%s: encode payload: %w", op, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.saveSegment(seg); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return s.enqueueJob(job.TypePercentBackfill, payload), nil
+}
+
+// saveSegment stores a copy of the segment and fills its ID and timestamps. Callers hold s.mu.
+func (s *Storage) saveSegment(seg *segment.Segment) (*segment.Segment, error) {
+	if _, ok := s.slugs[seg.Slug]; ok {
+		return nil, storage.ErrSegmentExists
+	}
+
+	if seg.Tags == nil {
+		seg.Tags = []string{}
+	}
+	if seg.Status == "" {
+		seg.Status = segment.StatusActive
+	}
+
+	s.lastSegmentID++
+	seg.ID = s.lastSegmentID
+	seg.CreatedAt = time.Now()
+	seg.UpdatedAt = seg.CreatedAt
+
+	stored := copySegment(seg)
+	s.segments[stored.ID] = stored
+	s.slugs[stored.Slug] = stored.ID
+
+	return stored, nil
+}
+
+func (s *Storage) BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (*storage.BackfillPage, error) {
+	const op = "storage.memory.BackfillSegmentPercent"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segmentID, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	seg := s.segments[segmentID]
+
+	var userIDs []int64
+	for userID := range s.users {
+		if userID > afterUserID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	if len(userIDs) > limit {
+		userIDs = userIDs[:limit]
+	}
+
+	page := &storage.BackfillPage{Scanned: len(userIDs)}
+	for _, userID := range userIDs {
+		page.LastUserID = userID
+
+		if _, ok := s.memberships[userID][segmentID]; ok || !bucket.Contains(seg.Slug, userID, seg.Percent) {
+			continue
+		}
+
+		s.addMembership(userID, seg, nil, history.ReasonAuto)
+		page.Enrolled++
+	}
+
+	return page, nil
+}
+
+func (s *Storage) GetSegmentBySlug(ctx context.Context, slug string) (*segment.Segment, error) {
+	const op = "storage.memory.GetSegmentBySlug"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	return copySegment(s.segments[id]), nil
+}
+
+func (s *Storage) GetSegments(ctx context.Context, filter storage.SegmentFilter) ([]*segment.Segment, int64, error) {
+	const op = "storage.memory.GetSegments"
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []*segment.Segment
+	for _, seg := range s.segments {
+		if matchSegment(seg, filter) {
+			matched = append(matched, seg)
+		}
+	}
+
+	// less orders segments by the sort value and then by id
+	less := func(a, b *segment.Segment) bool {
+		if c := compareSegments(a, b, filter.Sort); c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	}
+	if filter.Desc {
+		asc := less
+		less = func(a, b *segment.Segment) bool { return asc(b, a) }
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	start := 0
+	if filter.After != nil {
+		after, err := segmentAt(filter.After, filter.Sort)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		start = sort.Search(len(matched), func(i int) bool { return less(after, matched[i]) })
+	}
+
+	end := start + filter.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	segments := make([]*segment.Segment, 0, end-start)
+	for _, seg := range matched[start:end] {
+		segments = append(segments, copySegment(seg))
+	}
+
+	return segments, int64(len(matched)), nil
+}
+
+func matchSegment(seg *segment.Segment, filter storage.SegmentFilter) bool {
+	if filter.Query != "" && !strings.Contains(strings.ToLower(seg.Slug), strings.ToLower(filter.Query)) {
+		return false
+	}
+	if filter.Prefix != "" && !strings.HasPrefix(seg.Slug, filter.Prefix) {
+		return false
+	}
+	if filter.Owner != "" && seg.Owner != filter.Owner {
+		return false
+	}
+	if filter.Status != "" && seg.Status != filter.Status {
+		return false
+	}
+
+	for _, tag := range filter.Tags {
+		if !slices.Contains(seg.Tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareSegments(a, b *segment.Segment, sortBy string) int {
+	switch sortBy {
+	case storage.SortSegmentsBySlug:
+		return strings.Compare(a.Slug, b.Slug)
+	case storage.SortSegmentsByCreatedAt:
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case storage.SortSegmentsByUpdatedAt:
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	default:
+		return 0
+	}
+}
+
+// segmentAt returns a segment placed at the cursor position, to be compared with the stored ones.
+func segmentAt(c *storage.SegmentCursor, sortBy string) (*segment.Segment, error) {
+	seg := &segment.Segment{ID: c.ID}
+
+	switch sortBy {
+	case storage.SortSegmentsBySlug:
+		seg.Slug = c.Value
+	case storage.SortSegmentsByCreatedAt, storage.SortSegmentsByUpdatedAt:
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		seg.CreatedAt, seg.UpdatedAt = t, t
+	}
+
+	return seg, nil
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, slug string, upd storage.SegmentUpdate) (*segment.Segment, error) {
+	const op = "storage.memory.UpdateSegment"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	seg := s.segments[id]
+	if upd.Description != nil {
+		seg.Description = *upd.Description
+	}
+	if upd.Owner != nil {
+		seg.Owner = *upd.Owner
+	}
+	if upd.Tags != nil {
+		seg.Tags = append([]string{}, upd.Tags...)
+	}
+	if upd.Status != nil {
+		seg.Status = *upd.Status
+	}
+	if upd.Rule != nil {
+		seg.Rule = copyRule(*upd.Rule)
+	}
+	seg.UpdatedAt = time.Now()
+
+	return copySegment(seg), nil
+}
+
+func (s *Storage) DeleteSegmentBySlug(ctx context.Context, slug string) error {
+	const op = "storage.memory.DeleteSegmentBySlug"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.slugs[slug]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotExists)
+	}
+
+	seg := s.segments[id]
+	for userID, userSegments := range s.memberships {
+		if _, ok := userSegments[id]; ok {
+			s.deleteMembership(userID, seg, history.ReasonSegmentDeleted)
+		}
+	}
+
+	// experiments limited to the segment go with it, as with ON DELETE CASCADE of postgres
+	for expID, exp := range s.experiments {
+		if exp.Segment == slug {
+			delete(s.experiments, expID)
+		}
+	}
+
+	delete(s.segments, id)
+	delete(s.slugs, slug)
+
+	return nil
+}
+
+func (s *Storage) GetSegmentMembers(ctx context.Context, slug string, filter storage.MemberFilter) ([]*segment.Member, error) {
+	const op = "storage.memory.GetSegmentMembers"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segmentID, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	var members []*segment.Member
+	for userID, userSegments := range s.memberships {
+		m, ok := userSegments[segmentID]
+		if !ok || userID <= filter.AfterUserID {
+			continue
+		}
+		if filter.ExpiringBefore != nil && (m.deleteAt == nil || !m.deleteAt.Before(*filter.ExpiringBefore)) {
+			continue
+		}
+
+		member := &segment.Member{UserID: userID, Name: s.users[userID].Name}
+		if m.deleteAt != nil {
+			deleteAt := *m.deleteAt
+			member.DeleteAt = &deleteAt
+		}
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+
+	if len(members) > filter.Limit {
+		members = members[:filter.Limit]
+	}
+
+	return members, nil
+}
+
+func (s *Storage) GetSegmentStats(ctx context.Context, slug string) (*segment.Stats, error) {
+	const op = "storage.memory.GetSegmentStats"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segmentID, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	stats := &segment.Stats{Slug: slug}
+	for _, userSegments := range s.memberships {
+		if m, ok := userSegments[segmentID]; ok {
+			stats.Members++
+			if m.deleteAt != nil {
+				stats.Expiring++
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// AddSegmentUsers adds users to the segment. All users are changed at once,
+// there is no need for batches in memory.
+func (s *Storage) AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (*storage.BulkResult, error) {
+	const op = "storage.memory.AddSegmentUsers"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segmentID, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	seg := s.segments[segmentID]
+
+	result := &storage.BulkResult{}
+	seen := make(map[int64]struct{}, len(members))
+	for _, member := range members {
+		if _, ok := seen[member.UserID]; ok {
+			result.Fail(member.UserID, storage.BulkFailureDuplicate)
+			continue
+		}
+		seen[member.UserID] = struct{}{}
+
+		if _, ok := s.users[member.UserID]; !ok {
+			result.Fail(member.UserID, storage.BulkFailureUserNotFound)
+			continue
+		}
+		if _, ok := s.memberships[member.UserID][segmentID]; ok {
+			result.Fail(member.UserID, storage.BulkFailureAlreadyMember)
+			continue
+		}
+
+		var deleteAt *time.Time
+		if member.DeleteAt != nil {
+			t := *member.DeleteAt
+			deleteAt = &t
+		}
+
+		s.addMembership(member.UserID, seg, deleteAt, history.ReasonBulk)
+		result.Changed++
+	}
+
+	return result, nil
+}
+
+func (s *Storage) RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*storage.BulkResult, error) {
+	const op = "storage.memory.RemoveSegmentUsers"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segmentID, ok := s.slugs[slug]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	seg := s.segments[segmentID]
+
+	result := &storage.BulkResult{}
+	seen := make(map[int64]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			result.Fail(userID, storage.BulkFailureDuplicate)
+			continue
+		}
+		seen[userID] = struct{}{}
+
+		if _, ok := s.memberships[userID][segmentID]; !ok {
+			result.Fail(userID, storage.BulkFailureNotMember)
+			continue
+		}
+
+		s.deleteMembership(userID, seg, history.ReasonBulk)
+		result.Changed++
+	}
+
+	return result, nil
+}
+
+func (s *Storage) GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error) {
+	const op = "storage.memory.GetUserSegments"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segments := make([]*segment.Segment, 0, len(s.memberships[userID]))
+	for segmentID := range s.memberships[userID] {
+		segments = append(segments, copySegment(s.segments[segmentID]))
+	}
+
+	if usr, ok := s.users[userID]; ok {
+		for id, seg := range s.segments {
+			if _, member := s.memberships[userID][id]; !member && seg.Rule.Match(usr.Attributes) {
+				segments = append(segments, copySegment(seg))
+			}
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
+
+	return segments, nil
+}
+
+// ConfigureUserSegments adds and deletes the user's segments atomically.
+// Either every change is applied or none: if any segment is rejected, nothing is changed
+// and the result lists only the rejected segments.
+// Unknown segments are rejected unless lenient is set, in which case they are skipped.
+func (s *Storage) ConfigureUserSegments(ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool) (*storage.ConfigureResult, error) {
+	const op = "storage.memory.ConfigureUserSegments"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	result := &storage.ConfigureResult{}
+
+	toDelete := make(map[string]struct{}, len(segDel))
+	for _, slug := range segDel {
+		toDelete[slug] = struct{}{}
+	}
+
+	// validate everything first, so a rejected request leaves no trace
+	var adds []storage.SegmentToAdd
+	seen := make(map[string]struct{}, len(segAdd))
+	for _, segmentToAdd := range segAdd {
+		if _, ok := toDelete[segmentToAdd.Slug]; ok {
+			result.Reject(segmentToAdd.Slug, storage.RejectReasonConflict)
+			continue
+		}
+
+		id, ok := s.slugs[segmentToAdd.Slug]
+		if !ok {
+			skipUnknownSegment(segmentToAdd.Slug, lenient, result)
+			continue
+		}
+
+		_, member := s.memberships[userID][id]
+		if _, dup := seen[segmentToAdd.Slug]; member || dup {
+			result.Reject(segmentToAdd.Slug, storage.RejectReasonAlreadyMember)
+			continue
+		}
+		seen[segmentToAdd.Slug] = struct{}{}
+
+		adds = append(adds, segmentToAdd)
+	}
+
+	var dels []*segment.Segment
+	for _, slug := range segDel {
+		id, ok := s.slugs[slug]
+		if !ok {
+			skipUnknownSegment(slug, lenient, result)
+			continue
+		}
+
+		if _, member := s.memberships[userID][id]; member {
+			dels = append(dels, s.segments[id])
+		}
+	}
+
+	if len(result.Rejected) > 0 {
+		rejected := &storage.ConfigureResult{Rejected: result.Rejected}
+		if len(rejected.Unknown()) > 0 {
+			return rejected, fmt.Errorf("%s: %w: %w", op, storage.ErrSegmentsRejected, storage.ErrSegmentNotFound)
+		}
+
+		return rejected, fmt.Errorf("%s: %w", op, storage.ErrSegmentsRejected)
+	}
+
+	for _, segmentToAdd := range adds {
+		seg := s.segments[s.slugs[segmentToAdd.Slug]]
+		s.addMembership(userID, seg, segmentToAdd.DeleteAt, history.ReasonManual)
+		result.Added = append(result.Added, seg.Slug)
+	}
+
+	for _, seg := range dels {
+		if _, member := s.memberships[userID][seg.ID]; !member {
+			continue
+		}
+		s.deleteMembership(userID, seg, history.ReasonManual)
+		result.Removed = append(result.Removed, seg.Slug)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) SetUserSegments(ctx context.Context, userID int64, segments []storage.SegmentToAdd, lenient bool) (*storage.ConfigureResult, error) {
+	const op = "storage.memory.SetUserSegments"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	result := &storage.ConfigureResult{}
+
+	// validate everything first, so a rejected request leaves no trace
+	var sets []storage.SegmentToAdd
+	keep := make(map[int64]struct{}, len(segments))
+	for _, segmentToSet := range segments {
+		id, ok := s.slugs[segmentToSet.Slug]
+		if !ok {
+			skipUnknownSegment(segmentToSet.Slug, lenient, result)
+			continue
+		}
+
+		keep[id] = struct{}{}
+		sets = append(sets, segmentToSet)
+	}
+
+	if len(result.Rejected) > 0 {
+		rejected := &storage.ConfigureResult{Rejected: result.Rejected}
+		return rejected, fmt.Errorf("%s: %w: %w", op, storage.ErrSegmentsRejected, storage.ErrSegmentNotFound)
+	}
+
+	for _, segmentToSet := range sets {
+		seg := s.segments[s.slugs[segmentToSet.Slug]]
+
+		m, member := s.memberships[userID][seg.ID]
+		if member {
+			// a listed membership is removed once it is missing from the list
+			m.source = history.ReasonManual
+		}
+		switch {
+		case !member:
+			s.addMembership(userID, seg, segmentToSet.DeleteAt, history.ReasonManual)
+			result.Added = append(result.Added, seg.Slug)
+		case !sameTime(m.deleteAt, segmentToSet.DeleteAt):
+			m.deleteAt = copyTime(segmentToSet.DeleteAt)
+			s.record(userID, seg.Slug, history.OperationUpdate, history.ReasonManual, m.deleteAt)
+			result.Updated = append(result.Updated, seg.Slug)
+		}
+	}
+
+	var removed []*segment.Segment
+	for segmentID, m := range s.memberships[userID] {
+		if _, ok := keep[segmentID]; !ok && m.source != history.ReasonAuto {
+			removed = append(removed, s.segments[segmentID])
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Slug < removed[j].Slug })
+
+	for _, seg := range removed {
+		s.deleteMembership(userID, seg, history.ReasonManual)
+		result.Removed = append(result.Removed, seg.Slug)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) DeleteSegmentsTTL(ctx context.Context) (int64, error) {
+	const op = "storage.memory.DeleteSegmentsTTL"
+
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var deleted int64
+	for userID, userSegments := range s.memberships {
+		for segmentID, m := range userSegments {
+			if m.deleteAt != nil && m.deleteAt.Before(now) {
+				s.deleteMembership(userID, s.segments[segmentID], history.ReasonTTL)
+				deleted++
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) ([]string, error) {
+	const op = "storage.memory.GetUserSegmentsAt"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// the history is in chronological order, so the last record of a segment wins
+	last := make(map[string]*history.Record)
+	for _, rec := range s.history {
+		if rec.UserID == userID && !rec.CreatedAt.After(at) {
+			last[rec.Segment] = rec
+		}
+	}
+
+	slugs := []string{}
+	for slug, rec := range last {
+		active := rec.Operation == history.OperationAdd || rec.Operation == history.OperationUpdate
+		if active && (rec.DeleteAt == nil || rec.DeleteAt.After(at)) {
+			slugs = append(slugs, slug)
+		}
+	}
+	sort.Strings(slugs)
+
+	return slugs, nil
+}
+
+func (s *Storage) GetUserHistory(ctx context.Context, userID int64, from, to time.Time) ([]*history.Record, error) {
+	const op = "storage.memory.GetUserHistory"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var records []*history.Record
+	for _, rec := range s.history {
+		if rec.UserID == userID && !rec.CreatedAt.Before(from) && rec.CreatedAt.Before(to) {
+			cp := *rec
+			cp.DeleteAt = copyTime(rec.DeleteAt)
+			records = append(records, &cp)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Storage) SaveAPIKey(ctx context.Context, name, role, hash string) (*apikey.APIKey, error) {
+	const op = "storage.memory.SaveAPIKey"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apiKeyHashes[hash]; ok {
+		return nil, fmt.Errorf("%s: duplicate key hash", op)
+	}
+
+	s.lastAPIKeyID++
+	key := &apikey.APIKey{ID: s.lastAPIKeyID, Name: name, Role: role, CreatedAt: time.Now()}
+	s.apiKeys[key.ID] = key
+	s.apiKeyHashes[hash] = key.ID
+
+	return copyAPIKey(key), nil
+}
+
+func (s *Storage) GetAPIKeyByHash(ctx context.Context, hash string) (*apikey.APIKey, error) {
+	const op = "storage.memory.GetAPIKeyByHash"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.apiKeyHashes[hash]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+
+	return copyAPIKey(s.apiKeys[id]), nil
+}
+
+func (s *Storage) GetAPIKeys(ctx context.Context) ([]*apikey.APIKey, error) {
+	const op = "storage.memory.GetAPIKeys"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]*apikey.APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) error {
+	const op = "storage.memory.RevokeAPIKey"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.Revoked() {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+
+	return nil
+}
+
+func (s *Storage) EnqueueJob(ctx context.Context, typ string, payload []byte) (*job.Job, error) {
+	const op = "storage.memory.EnqueueJob"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enqueueJob(typ, payload), nil
+}
+
+// enqueueJob stores a queued job and returns its copy. Callers hold s.mu.
+func (s *Storage) enqueueJob(typ string, payload []byte) *job.Job {
+	s.lastJobID++
+	stored := &storedJob{Job: job.Job{
+		ID:        s.lastJobID,
+		Type:      typ,
+		Status:    job.StatusQueued,
+		Payload:   append([]byte{}, payload...),
+		CreatedAt: time.Now(),
+	}}
+	s.jobs[stored.ID] = stored
+
+	return copyJob(&stored.Job)
+}
+
+func (s *Storage) GetJob(ctx context.Context, id int64) (*job.Job, error) {
+	const op = "storage.memory.GetJob"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrJobNotFound)
+	}
+
+	return copyJob(&stored.Job), nil
+}
+
+func (s *Storage) ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (*job.Job, error) {
+	const op = "storage.memory.ClaimJob"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var claimed *storedJob
+	for _, stored := range s.jobs {
+		expired := stored.Status == job.StatusRunning && stored.lockedUntil.Before(now)
+		if expired && stored.Attempts >= maxAttempts {
+			// workers of the job died every time they ran it
+			stored.Status = job.StatusFailed
+			stored.Error = "lease expired"
+			stored.FinishedAt = &now
+			continue
+		}
+
+		if (stored.Status == job.StatusQueued || expired) && (claimed == nil || stored.ID < claimed.ID) {
+			claimed = stored
+		}
+	}
+
+	if claimed == nil {
+		return nil, nil
+	}
+
+	claimed.Status = job.StatusRunning
+	claimed.Attempts++
+	claimed.lockedUntil = now.Add(lease)
+	if claimed.StartedAt == nil {
+		claimed.StartedAt = &now
+	}
+
+	return copyJob(&claimed.Job), nil
+}
+
+func (s *Storage) UpdateJobProgress(ctx context.Context, j *job.Job, lease time.Duration) error {
+	const op = "storage.memory.UpdateJobProgress"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.leasedJob(j)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	stored.Progress = j.Progress
+	stored.Result = append([]byte(nil), j.Result...)
+	stored.lockedUntil = time.Now().Add(lease)
+
+	return nil
+}
+
+func (s *Storage) FinishJob(ctx context.Context, j *job.Job) error {
+	const op = "storage.memory.FinishJob"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.leasedJob(j)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	j.Status = job.StatusSucceeded
+	if j.Error != "" {
+		j.Status = job.StatusFailed
+	}
+
+	now := time.Now()
+	stored.Status = j.Status
+	stored.Error = j.Error
+	stored.Result = append([]byte(nil), j.Result...)
+	stored.Progress = j.Progress
+	stored.FinishedAt = &now
+
+	return nil
+}
+
+func (s *Storage) ReleaseJob(ctx context.Context, j *job.Job) error {
+	const op = "storage.memory.ReleaseJob"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.leasedJob(j)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the interrupted attempt is not counted
+	stored.Status = job.StatusQueued
+	stored.Attempts--
+	stored.Progress = j.Progress
+	stored.Result = append([]byte(nil), j.Result...)
+
+	return nil
+}
+
+// leasedJob returns the stored job if it is still leased by the worker holding j.
+func (s *Storage) leasedJob(j *job.Job) (*storedJob, error) {
+	stored, ok := s.jobs[j.ID]
+	if !ok || stored.Status != job.StatusRunning || stored.Attempts != j.Attempts {
+		return nil, storage.ErrJobNotFound
+	}
+
+	return stored, nil
+}
+
+func (s *Storage) ClaimIdempotencyKey(ctx context.Context, rec *idempotency.Record, lockTimeout time.Duration) (*idempotency.Record, error) {
+	const op = "storage.memory.ClaimIdempotencyKey"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	key := idempotencyKey{apiKeyID: rec.APIKeyID, key: rec.Key}
+	// an expired record of the key may be left until the next sweep, the key is free then
+	if stored, ok := s.idempotency[key]; ok && !stored.expiresAt.Before(now) {
+		return copyIdempotencyRecord(&stored.Record), fmt.Errorf("%s: %w", op, storage.ErrIdempotencyKeyExists)
+	}
+
+	s.idempotency[key] = &storedIdempotencyRecord{
+		Record:    *copyIdempotencyRecord(rec),
+		expiresAt: now.Add(lockTimeout),
+	}
+
+	return rec, nil
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	const op = "storage.memory.DeleteExpiredIdempotencyKeys"
+
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var deleted int64
+	for key, stored := range s.idempotency {
+		if stored.expiresAt.Before(now) {
+			delete(s.idempotency, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, rec *idempotency.Record, ttl time.Duration) error {
+	const op = "storage.memory.CompleteIdempotencyKey"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[idempotencyKey{apiKeyID: rec.APIKeyID, key: rec.Key}]
+	if !ok {
+		return nil
+	}
+
+	stored.StatusCode = rec.StatusCode
+	stored.ContentType = rec.ContentType
+	stored.Body = append([]byte(nil), rec.Body...)
+	stored.expiresAt = time.Now().Add(ttl)
+
+	return nil
+}
+
+func (s *Storage) DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string) error {
+	const op = "storage.memory.DeleteIdempotencyKey"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, idempotencyKey{apiKeyID: apiKeyID, key: key})
+
+	return nil
+}
+
+func (s *Storage) SaveWebhook(ctx context.Context, url, secret string) (*webhook.Webhook, error) {
+	const op = "storage.memory.SaveWebhook"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastWebhookID++
+	wh := &webhook.Webhook{
+		ID:        s.lastWebhookID,
+		URL:       url,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	s.webhooks[wh.ID] = wh
+
+	cp := *wh
+	return &cp, nil
+}
+
+func (s *Storage) GetWebhooks(ctx context.Context) ([]*webhook.Webhook, error) {
+	const op = "storage.memory.GetWebhooks"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhooks := make([]*webhook.Webhook, 0, len(s.webhooks))
+	byID := make(map[int64]*webhook.Webhook, len(s.webhooks))
+	for _, wh := range s.webhooks {
+		cp := *wh
+		cp.Secret = ""
+		webhooks = append(webhooks, &cp)
+		byID[cp.ID] = &cp
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+
+	for _, d := range s.deliveries {
+		switch d.Status {
+		case webhook.DeliveryPending:
+			byID[d.WebhookID].Pending++
+		case webhook.DeliveryFailed:
+			byID[d.WebhookID].Failed++
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) error {
+	const op = "storage.memory.DeleteWebhook"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[id]; !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+
+	delete(s.webhooks, id)
+	for deliveryID, d := range s.deliveries {
+		if d.WebhookID == id {
+			delete(s.deliveries, deliveryID)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) FanOutOutboxEvents(ctx context.Context, limit int) (int, error) {
+	const op = "storage.memory.FanOutOutboxEvents"
+
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.outbox
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	webhookIDs := make([]int64, 0, len(s.webhooks))
+	for id := range s.webhooks {
+		webhookIDs = append(webhookIDs, id)
+	}
+	slices.Sort(webhookIDs)
+
+	now := time.Now()
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return 0, fmt.Errorf("%s: marshal event: %w", op, err)
+		}
+
+		for _, webhookID := range webhookIDs {
+			s.lastDeliveryID++
+			s.deliveries[s.lastDeliveryID] = &storedDelivery{Delivery: webhook.Delivery{
+				ID:            s.lastDeliveryID,
+				WebhookID:     webhookID,
+				EventID:       event.ID,
+				EventType:     event.Type,
+				Payload:       payload,
+				Status:        webhook.DeliveryPending,
+				NextAttemptAt: now,
+			}}
+		}
+	}
+
+	s.outbox = s.outbox[len(events):]
+
+	return len(events), nil
+}
+
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*webhook.Delivery, error) {
+	const op = "storage.memory.ClaimWebhookDeliveries"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var due []*storedDelivery
+	for _, d := range s.deliveries {
+		if d.Status == webhook.DeliveryPending && !d.NextAttemptAt.After(now) && d.lockedUntil.Before(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	deliveries := make([]*webhook.Delivery, 0, len(due))
+	for _, d := range due {
+		d.Attempts++
+		d.lockedUntil = now.Add(lease)
+
+		wh := s.webhooks[d.WebhookID]
+		cp := d.Delivery
+		cp.URL, cp.Secret = wh.URL, wh.Secret
+		cp.Payload = append([]byte(nil), d.Payload...)
+		deliveries = append(deliveries, &cp)
+	}
+
+	return deliveries, nil
+}
+
+func (s *Storage) FinishWebhookDelivery(ctx context.Context, d *webhook.Delivery) error {
+	const op = "storage.memory.FinishWebhookDelivery"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.deliveries[d.ID]
+	if !ok {
+		return nil
+	}
+
+	if d.Status == webhook.DeliveryDelivered {
+		delete(s.deliveries, d.ID)
+		return nil
+	}
+
+	stored.Status = d.Status
+	stored.Attempts = d.Attempts
+	stored.NextAttemptAt = d.NextAttemptAt
+	stored.LastError = d.LastError
+	stored.lockedUntil = time.Time{}
+
+	return nil
+}
+
+func (s *Storage) SaveExperiment(ctx context.Context, exp *experiment.Experiment) error {
+	const op = "storage.memory.SaveExperiment"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.experiments {
+		if other.Slug == exp.Slug {
+			return fmt.Errorf("%s: %w", op, storage.ErrExperimentExists)
+		}
+	}
+
+	if _, ok := s.slugs[exp.Segment]; exp.Segment != "" && !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	s.lastExperimentID++
+	exp.ID = s.lastExperimentID
+	exp.CreatedAt = time.Now()
+	s.experiments[exp.ID] = copyExperiment(exp)
+
+	return nil
+}
+
+func (s *Storage) GetExperiments(ctx context.Context) ([]*experiment.Experiment, error) {
+	const op = "storage.memory.GetExperiments"
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	experiments := make([]*experiment.Experiment, 0, len(s.experiments))
+	for _, exp := range s.experiments {
+		experiments = append(experiments, copyExperiment(exp))
+	}
+	sort.Slice(experiments, func(i, j int) bool { return experiments[i].ID < experiments[j].ID })
+
+	return experiments, nil
+}
+
+func (s *Storage) DeleteExperiment(ctx context.Context, slug string) error {
+	const op = "storage.memory.DeleteExperiment"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, exp := range s.experiments {
+		if exp.Slug == slug {
+			delete(s.experiments, id)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", op, storage.ErrExperimentNotFound)
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	const op = "storage.memory.Ping"
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+// addMembership adds the user to the segment and records it in the history. Callers hold s.mu.
+func (s *Storage) addMembership(userID int64, seg *segment.Segment, deleteAt *time.Time, reason string) {
+	if s.memberships[userID] == nil {
+		s.memberships[userID] = make(map[int64]*membership)
+	}
+	s.memberships[userID][seg.ID] = &membership{deleteAt: deleteAt, source: reason}
+	s.record(userID, seg.Slug, history.OperationAdd, reason, deleteAt)
+}
+
+// deleteMembership removes the user from the segment and records it in the history. Callers hold s.mu.
+func (s *Storage) deleteMembership(userID int64, seg *segment.Segment, reason string) {
+	delete(s.memberships[userID], seg.ID)
+	s.record(userID, seg.Slug, history.OperationDelete, reason, nil)
+}
+
+func (s *Storage) record(userID int64, slug, operation, reason string, deleteAt *time.Time) {
+	s.lastHistoryID++
+	rec := &history.Record{
+		ID:        s.lastHistoryID,
+		UserID:    userID,
+		Segment:   slug,
+		Operation: operation,
+		Reason:    reason,
+		DeleteAt:  copyTime(deleteAt),
+		CreatedAt: time.Now(),
+	}
+	s.history = append(s.history, rec)
+
+	// the event id is the history record id, as with the outbox trigger of postgres
+	s.outbox = append(s.outbox, &webhook.Event{
+		ID:         rec.ID,
+		Type:       webhook.EventType(operation),
+		UserID:     userID,
+		Segment:    slug,
+		Reason:     reason,
+		DeleteAt:   copyTime(deleteAt),
+		OccurredAt: rec.CreatedAt,
+	})
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	cp := *t
+	return &cp
+}
+
+func skipUnknownSegment(slug string, lenient bool, result *storage.ConfigureResult) {
+	if lenient {
+		result.Ignored = append(result.Ignored, slug)
+		return
+	}
+
+	result.Reject(slug, storage.RejectReasonNotFound)
+}
+
+func copyUser(usr *user.User) *user.User {
+	cp := *usr
+	cp.Attributes = copyAttributes(usr.Attributes)
+
+	return &cp
+}
+
+// copyAttributes copies the map, the values are immutable.
+func copyAttributes(attrs user.Attributes) user.Attributes {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	cp := make(user.Attributes, len(attrs))
+	for k, v := range attrs {
+		cp[k] = v
+	}
+
+	return cp
+}
+
+// copyRule copies the conditions, lists of values are not modified in place, so they are shared.
+func copyRule(rule segment.Rule) segment.Rule {
+	if len(rule) == 0 {
+		return nil
+	}
+
+	return append(segment.Rule(nil), rule...)
+}
+
+func copyAPIKey(key *apikey.APIKey) *apikey.APIKey {
+	cp := *key
+	if key.RevokedAt != nil {
+		revokedAt := *key.RevokedAt
+		cp.RevokedAt = &revokedAt
+	}
+
+	return &cp
+}
+
+func copyIdempotencyRecord(rec *idempotency.Record) *idempotency.Record {
+	cp := *rec
+	cp.Body = append([]byte(nil), rec.Body...)
+
+	return &cp
+}
+
+func copyJob(j *job.Job) *job.Job {
+	cp := *j
+	cp.Payload = append([]byte(nil), j.Payload...)
+	cp.Result = append([]byte(nil), j.Result...)
+	if j.StartedAt != nil {
+		startedAt := *j.StartedAt
+		cp.StartedAt = &startedAt
+	}
+	if j.FinishedAt != nil {
+		finishedAt := *j.FinishedAt
+		cp.FinishedAt = &finishedAt
+	}
+
+	return &cp
+}
+
+func copyExperiment(exp *experiment.Experiment) *experiment.Experiment {
+	cp := *exp
+	cp.Variants = append([]experiment.Variant(nil), exp.Variants...)
+
+	return &cp
+}
+
+func copySegment(seg *segment.Segment) *segment.Segment {
+	cp := *seg
+	if seg.Tags != nil {
+		cp.Tags = append([]string{}, seg.Tags...)
+	}
+	cp.Rule = copyRule(seg.Rule)
+
+	return &cp
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_segments_history
+(
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT       NOT NULL,
+    segment    VARCHAR(512) NOT NULL,
+    operation  VARCHAR(16)  NOT NULL,
+    reason     VARCHAR(32)  NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_segments_history_user_id_created_at_idx
+    ON user_segments_history (user_id, created_at);
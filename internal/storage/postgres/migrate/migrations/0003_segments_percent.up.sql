@@ -0,0 +1,2 @@
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS percent SMALLINT NOT NULL DEFAULT 0 CHECK (percent BETWEEN 0 AND 100);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id         BIGSERIAL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    key_hash   CHAR(64)     NOT NULL UNIQUE,
+    role       VARCHAR(16)  NOT NULL CHECK (role IN ('reader', 'analyst', 'admin')),
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
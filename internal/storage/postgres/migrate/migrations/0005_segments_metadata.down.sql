@@ -0,0 +1,6 @@
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS owner,
+    DROP COLUMN IF EXISTS tags,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS updated_at;
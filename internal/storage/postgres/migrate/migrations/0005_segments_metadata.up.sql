@@ -0,0 +1,6 @@
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS description TEXT         NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS owner       VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tags        TEXT[]       NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    ADD COLUMN IF NOT EXISTS updated_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW();
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS segments_updated_at_id_idx;
+DROP INDEX IF EXISTS segments_created_at_id_idx;
+DROP INDEX IF EXISTS segments_tags_idx;
+DROP INDEX IF EXISTS segments_owner_idx;
+
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS status;
@@ -0,0 +1,7 @@
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'archived'));
+
+CREATE INDEX IF NOT EXISTS segments_owner_idx ON segments (owner);
+CREATE INDEX IF NOT EXISTS segments_tags_idx ON segments USING GIN (tags);
+CREATE INDEX IF NOT EXISTS segments_created_at_id_idx ON segments (created_at, id);
+CREATE INDEX IF NOT EXISTS segments_updated_at_id_idx ON segments (updated_at, id);
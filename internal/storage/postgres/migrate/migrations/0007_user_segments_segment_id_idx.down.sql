@@ -0,0 +1 @@
+DROP INDEX IF EXISTS user_segments_segment_id_user_id_idx;
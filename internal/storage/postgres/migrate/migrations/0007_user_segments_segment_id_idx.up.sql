@@ -0,0 +1,2 @@
+-- members of a segment are listed by segment_id and user_id, the unique index starts with user_id
+CREATE INDEX IF NOT EXISTS user_segments_segment_id_user_id_idx ON user_segments (segment_id, user_id);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS jobs
+(
+    id             BIGSERIAL PRIMARY KEY,
+    type           VARCHAR(32) NOT NULL,
+    status         VARCHAR(16) NOT NULL DEFAULT 'queued',
+    payload        JSONB       NOT NULL,
+    result         JSONB,
+    error          TEXT        NOT NULL DEFAULT '',
+    progress_done  BIGINT      NOT NULL DEFAULT 0,
+    progress_total BIGINT      NOT NULL DEFAULT 0,
+    attempts       INT         NOT NULL DEFAULT 0,
+    -- a running job is taken over by another worker when its lease expires
+    locked_until   TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at     TIMESTAMPTZ,
+    finished_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs (id) WHERE status IN ('queued', 'running');
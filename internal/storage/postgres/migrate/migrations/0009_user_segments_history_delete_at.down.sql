@@ -0,0 +1,2 @@
+ALTER TABLE user_segments_history
+    DROP COLUMN IF EXISTS delete_at;
@@ -0,0 +1,3 @@
+-- delete_at of added memberships, so memberships expired before the TTL sweep are known
+ALTER TABLE user_segments_history
+    ADD COLUMN IF NOT EXISTS delete_at TIMESTAMP DEFAULT NULL;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    -- 0 for requests without an API key
+    api_key_id   BIGINT       NOT NULL DEFAULT 0,
+    key          VARCHAR(255) NOT NULL,
+    request_hash CHAR(64)     NOT NULL,
+    status_code  INT          NOT NULL DEFAULT 0,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    body         BYTEA,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    expires_at   TIMESTAMPTZ  NOT NULL,
+    PRIMARY KEY (api_key_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
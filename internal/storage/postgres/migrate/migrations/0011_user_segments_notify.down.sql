@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS segments_updated_notify ON segments;
+DROP TRIGGER IF EXISTS user_segments_deleted_notify ON user_segments;
+DROP TRIGGER IF EXISTS user_segments_updated_notify ON user_segments;
+DROP TRIGGER IF EXISTS user_segments_inserted_notify ON user_segments;
+DROP FUNCTION IF EXISTS notify_user_segments_changed();
@@ -0,0 +1,47 @@
+-- instances cache user segments and drop them on these notifications. The payload is a comma-separated list
+-- of user ids, or '*' when the segments themselves or too many users changed (payloads are limited to 8000 bytes).
+CREATE OR REPLACE FUNCTION notify_user_segments_changed() RETURNS TRIGGER AS
+$$
+DECLARE
+    user_ids BIGINT[];
+BEGIN
+    IF TG_TABLE_NAME = 'segments' THEN
+        PERFORM pg_notify('user_segments_changed', '*');
+        RETURN NULL;
+    END IF;
+
+    SELECT array_agg(DISTINCT user_id) INTO user_ids FROM changed;
+    IF user_ids IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF cardinality(user_ids) > 300 THEN
+        PERFORM pg_notify('user_segments_changed', '*');
+    ELSE
+        PERFORM pg_notify('user_segments_changed', array_to_string(user_ids, ','));
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- transition tables may not be shared by several events, hence a trigger per event
+CREATE TRIGGER user_segments_inserted_notify
+    AFTER INSERT ON user_segments
+    REFERENCING NEW TABLE AS changed
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_user_segments_changed();
+
+CREATE TRIGGER user_segments_updated_notify
+    AFTER UPDATE ON user_segments
+    REFERENCING NEW TABLE AS changed
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_user_segments_changed();
+
+CREATE TRIGGER user_segments_deleted_notify
+    AFTER DELETE ON user_segments
+    REFERENCING OLD TABLE AS changed
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_user_segments_changed();
+
+-- cached segments carry the slug and percent
+CREATE TRIGGER segments_updated_notify
+    AFTER UPDATE OF slug, percent ON segments
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_user_segments_changed();
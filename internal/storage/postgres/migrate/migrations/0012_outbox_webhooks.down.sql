@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TRIGGER IF EXISTS user_segments_history_outbox ON user_segments_history;
+DROP FUNCTION IF EXISTS outbox_user_segments_history();
+DROP TABLE IF EXISTS outbox_events;
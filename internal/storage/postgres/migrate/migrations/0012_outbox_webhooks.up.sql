@@ -0,0 +1,54 @@
+-- every membership change recorded in the history is also written to the outbox in the same transaction.
+-- The dispatcher moves outbox events to deliveries of every webhook and deletes them.
+CREATE TABLE IF NOT EXISTS outbox_events
+(
+    -- the id of the history record
+    id         BIGINT PRIMARY KEY,
+    user_id    BIGINT       NOT NULL,
+    segment    VARCHAR(512) NOT NULL,
+    operation  VARCHAR(16)  NOT NULL,
+    reason     VARCHAR(32)  NOT NULL,
+    delete_at  TIMESTAMP,
+    created_at TIMESTAMPTZ  NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION outbox_user_segments_history() RETURNS TRIGGER AS
+$$
+BEGIN
+    INSERT INTO outbox_events(id, user_id, segment, operation, reason, delete_at, created_at)
+    VALUES (NEW.id, NEW.user_id, NEW.segment, NEW.operation, NEW.reason, NEW.delete_at, NEW.created_at);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_segments_history_outbox
+    AFTER INSERT ON user_segments_history
+    FOR EACH ROW EXECUTE FUNCTION outbox_user_segments_history();
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         BIGSERIAL PRIMARY KEY,
+    url        TEXT        NOT NULL,
+    secret     TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    webhook_id      BIGINT      NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id        BIGINT      NOT NULL,
+    event_type      VARCHAR(32) NOT NULL,
+    payload         JSONB       NOT NULL,
+    status          VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts        INT         NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error      TEXT        NOT NULL DEFAULT '',
+    -- a delivery in progress is taken over by another instance when its lease expires
+    locked_until    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx
+    ON webhook_deliveries (next_attempt_at, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS segments_rule_deleted_notify ON segments;
+DROP TRIGGER IF EXISTS segments_rule_updated_notify ON segments;
+DROP TRIGGER IF EXISTS segments_rule_inserted_notify ON segments;
+DROP TRIGGER IF EXISTS users_attributes_updated_notify ON users;
+DROP TRIGGER IF EXISTS users_attributes_inserted_notify ON users;
+DROP FUNCTION IF EXISTS notify_user_attributes_changed();
+ALTER TABLE segments DROP COLUMN IF EXISTS rule;
+ALTER TABLE users DROP COLUMN IF EXISTS attributes;
@@ -0,0 +1,38 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+-- segments with a rule include every user whose attributes match it, see segment.Rule
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS rule JSONB;
+
+CREATE OR REPLACE FUNCTION notify_user_attributes_changed() RETURNS TRIGGER AS
+$$
+BEGIN
+    PERFORM pg_notify('user_segments_changed', NEW.id::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- segments matched by rules change with the attributes
+CREATE TRIGGER users_attributes_inserted_notify
+    AFTER INSERT ON users
+    FOR EACH ROW WHEN (NEW.attributes <> '{}')
+    EXECUTE FUNCTION notify_user_attributes_changed();
+
+CREATE TRIGGER users_attributes_updated_notify
+    AFTER UPDATE OF attributes ON users
+    FOR EACH ROW WHEN (OLD.attributes IS DISTINCT FROM NEW.attributes)
+    EXECUTE FUNCTION notify_user_attributes_changed();
+
+-- segments with a rule may have no explicit members, so changes of user_segments do not cover them
+CREATE TRIGGER segments_rule_inserted_notify
+    AFTER INSERT ON segments
+    FOR EACH ROW WHEN (NEW.rule IS NOT NULL)
+    EXECUTE FUNCTION notify_user_segments_changed();
+
+CREATE TRIGGER segments_rule_updated_notify
+    AFTER UPDATE OF rule ON segments
+    FOR EACH ROW WHEN (OLD.rule IS DISTINCT FROM NEW.rule)
+    EXECUTE FUNCTION notify_user_segments_changed();
+
+CREATE TRIGGER segments_rule_deleted_notify
+    AFTER DELETE ON segments
+    FOR EACH ROW WHEN (OLD.rule IS NOT NULL)
+    EXECUTE FUNCTION notify_user_segments_changed();
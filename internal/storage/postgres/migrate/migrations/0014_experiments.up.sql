@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS experiments
+(
+    id          BIGSERIAL PRIMARY KEY,
+    slug        VARCHAR(512) NOT NULL UNIQUE,
+    description TEXT         NOT NULL DEFAULT '',
+    -- the experiment is limited to the members of the segment, if any, and is deleted with it
+    segment_id  BIGINT REFERENCES segments (id) ON DELETE CASCADE,
+    variants    JSONB        NOT NULL,
+    created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS experiments_segment_id_idx ON experiments (segment_id);
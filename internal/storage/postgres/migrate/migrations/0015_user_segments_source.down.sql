@@ -0,0 +1,2 @@
+ALTER TABLE user_segments
+    DROP COLUMN IF EXISTS source;
@@ -0,0 +1,16 @@
+-- how the membership was added: manual, auto (percentage segments) or bulk, so replacing the user's segments
+-- only touches manual memberships
+ALTER TABLE user_segments
+    ADD COLUMN IF NOT EXISTS source VARCHAR(32) NOT NULL DEFAULT 'manual';
+
+-- existing memberships take the reason of their latest addition
+UPDATE user_segments AS us
+SET source = h.reason
+FROM (
+    SELECT DISTINCT ON (user_id, segment) user_id, segment, reason
+    FROM user_segments_history
+    WHERE operation = 'add'
+    ORDER BY user_id, segment, created_at DESC, id DESC
+) AS h
+JOIN segments AS s ON s.slug = h.segment
+WHERE us.user_id = h.user_id AND us.segment_id = s.id AND h.reason IN ('auto', 'bulk');
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/lib/logger/sl"
+)
+
+const (
+	// userSegmentsChannel is notified by the triggers on user_segments and segments, see migration 0011.
+	userSegmentsChannel = "user_segments_changed"
+	// allUsers is the payload sent when the segments themselves or too many users changed.
+	allUsers = "*"
+
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	// listenerPingInterval is how often the connection is checked, a dead one is not noticed otherwise.
+	listenerPingInterval = 30 * time.Second
+)
+
+type UserSegmentsInvalidator interface {
+	InvalidateUserSegments(userIDs ...int64)
+	InvalidateAllUserSegments()
+}
+
+// UserSegmentsListener passes changes of user segments made by any instance to the invalidator.
+type UserSegmentsListener struct {
+	log         *slog.Logger
+	dsn         string
+	invalidator UserSegmentsInvalidator
+}
+
+func NewUserSegmentsListener(log *slog.Logger, creds config.Storage, invalidator UserSegmentsInvalidator) *UserSegmentsListener {
+	return &UserSegmentsListener{
+		log: log.With(
+			slog.String("component", "storage/postgres/listener"),
+		),
+		dsn:         dataSourceName(creds),
+		invalidator: invalidator,
+	}
+}
+
+// Run listens for notifications until ctx is done. The connection is reestablished on its own,
+// everything is invalidated when it is lost, since notifications sent in the meantime are missed.
+func (l *UserSegmentsListener) Run(ctx context.Context) {
+	listener := pq.NewListener(l.dsn, listenerMinReconnect, listenerMaxReconnect, l.handleEvent)
+	defer listener.Close()
+
+	if err := listener.Listen(userSegmentsChannel); err != nil {
+		l.log.Error("failed to listen", sl.Err(err))
+		return
+	}
+
+	l.log.Info("user segments listener started", slog.String("channel", userSegmentsChannel))
+
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.log.Info("user segments listener stopped")
+			return
+		case n := <-listener.Notify:
+			// nil is sent after the connection is reestablished
+			if n == nil {
+				l.invalidator.InvalidateAllUserSegments()
+				continue
+			}
+
+			l.handleNotification(n.Extra)
+		case <-ticker.C:
+			go func() {
+				_ = listener.Ping()
+			}()
+		}
+	}
+}
+
+func (l *UserSegmentsListener) handleEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected:
+		l.log.Debug("listener connected")
+	case pq.ListenerEventDisconnected:
+		l.log.Warn("listener disconnected", sl.Err(err))
+		l.invalidator.InvalidateAllUserSegments()
+	case pq.ListenerEventReconnected:
+		l.log.Info("listener reconnected")
+	case pq.ListenerEventConnectionAttemptFailed:
+		l.log.Error("listener failed to connect", sl.Err(err))
+	}
+}
+
+func (l *UserSegmentsListener) handleNotification(payload string) {
+	if payload == allUsers {
+		l.invalidator.InvalidateAllUserSegments()
+		return
+	}
+
+	fields := strings.Split(payload, ",")
+	userIDs := make([]int64, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			l.log.Error("invalid notification", slog.String("payload", payload), sl.Err(err))
+			l.invalidator.InvalidateAllUserSegments()
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	l.invalidator.InvalidateUserSegments(userIDs...)
+}
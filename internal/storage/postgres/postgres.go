@@ -1,387 +1,2260 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 
 	"avito-test-task-2023/internal/config"
-	"avito-test-task-2023/internal/http-server/handlers/users"
+	"avito-test-task-2023/internal/lib/bucket"
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/idempotency"
+	"avito-test-task-2023/internal/models/job"
 	"avito-test-task-2023/internal/models/segment"
 	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/models/webhook"
 	"avito-test-task-2023/internal/storage"
+	"avito-test-task-2023/internal/storage/postgres/migrate"
 )
 
+// enrollLockID is the advisory lock key which serializes creating users with creating percentage segments,
+// so that each of them sees the other one and a user is never missed by the enrollment.
+const enrollLockID = 20230830
+
 type Storage struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
 }
 
-func New(creds config.Storage) (*Storage, error) {
+var _ storage.Storage = (*Storage)(nil)
+
+// New connects to the database and, if enabled, applies pending migrations.
+// Every query is limited by creds.QueryTimeout on top of the caller's context.
+func New(ctx context.Context, creds config.Storage) (*Storage, error) {
 	const op = "storage.postgres.New"
 
-	psqlInfo := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
+	db, err := Connect(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if creds.AutoMigrate {
+		migrator, err := migrate.New(db)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if _, err := migrator.Up(ctx); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return &Storage{db: db, queryTimeout: creds.QueryTimeout}, nil
+}
+
+// Connect opens a connection pool to the database and checks it is reachable.
+func Connect(ctx context.Context, creds config.Storage) (*sql.DB, error) {
+	const op = "storage.postgres.Connect"
+
+	if creds.Database == "" {
+		return nil, fmt.Errorf("%s: database is not set", op)
+	}
+
+	db, err := sql.Open("postgres", dataSourceName(creds))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: ping failed: %w", op, err)
+	}
+
+	return db, nil
+}
+
+func dataSourceName(creds config.Storage) string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
 		creds.Username,
 		creds.Password,
 		creds.Host,
 		creds.Port,
 		creds.Database,
 	)
+}
+
+// SaveUser creates a user and enrolls them into every percentage segment whose share they fall into.
+func (s *Storage) SaveUser(ctx context.Context, name string, attrs user.Attributes) (*user.User, error) {
+	const op = "storage.postgres.SaveUser"
 
-	db, err := sql.Open("postgres", psqlInfo)
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	attrsJSON, err := attributesParam(attrs)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = initSchema(db)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// users are created concurrently, only percentage segments wait for them
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock_shared($1);`, enrollLockID); err != nil {
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	err = db.Ping()
+	usr := &user.User{Name: name, Attributes: attrs}
+	err = tx.QueryRowContext(ctx, `INSERT INTO users(name, attributes) VALUES ($1, $2::JSONB) RETURNING id;`, name, attrsJSON).Scan(&usr.ID)
 	if err != nil {
-		return nil, fmt.Errorf("%s: ping failed: %w", op, err)
+		// handle unique constraint error
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return &Storage{db}, nil
-}
-
-func initSchema(db *sql.DB) error {
-	op := "storage.postgres.initSchema"
-
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS users
-		(
-			id   BIGSERIAL PRIMARY KEY,
-			name VARCHAR(255) UNIQUE NOT NULL
-		);
-		
-		CREATE TABLE IF NOT EXISTS segments
-		(
-			id   BIGSERIAL PRIMARY KEY,
-			slug VARCHAR(512) UNIQUE NOT NULL
-		);
-		
-		CREATE TABLE IF NOT EXISTS user_segments
-		(
-			id         BIGSERIAL PRIMARY KEY,
-			user_id    BIGINT REFERENCES users (id) ON DELETE CASCADE,
-			segment_id BIGINT REFERENCES segments (id) ON DELETE CASCADE,
-			delete_at  TIMESTAMP DEFAULT NULL,
-			UNIQUE (user_id, segment_id)
-		);
-	`)
+	rows, err := tx.QueryContext(ctx, `SELECT id, slug, percent FROM segments WHERE percent > 0;`)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return nil
+	var autoSegments []*segment.Segment
+	for rows.Next() {
+		seg := &segment.Segment{}
+		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Percent); err != nil {
+			rows.Close()
+			return nil, wrapErr(ctx, op, err)
+		}
+		if bucket.Contains(seg.Slug, usr.ID, seg.Percent) {
+			autoSegments = append(autoSegments, seg)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	for _, seg := range autoSegments {
+		if _, err := enrollUsers(ctx, tx, seg, []int64{usr.ID}); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: commit tx: %w", op, err)
+	}
+
+	return usr, nil
 }
 
-func (s *Storage) SaveUser(name string) error {
-	const op = "storage.postgres.SaveUser"
+func (s *Storage) GetUser(ctx context.Context, id int64) (*user.User, error) {
+	const op = "storage.postgres.GetUser"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	usr := &user.User{}
+	err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1;`, id), usr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return usr, nil
+}
+
+// GetUsers returns a page of users ordered by id whose name contains the given substring
+// (all users if it is empty), and the total number of matching users.
+func (s *Storage) GetUsers(ctx context.Context, limit, offset int, name string) ([]*user.User, int64, error) {
+	const op = "storage.postgres.GetUsers"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	pattern := "%" + escapeLike(name) + "%"
+
+	var total int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE name ILIKE $1;`, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, wrapErr(ctx, op, err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+` FROM users
+		WHERE name ILIKE $1
+		ORDER BY id
+		LIMIT $2 OFFSET $3;
+	`, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	users := make([]*user.User, 0, limit)
+	for rows.Next() {
+		usr := &user.User{}
+		if err := scanUser(rows, usr); err != nil {
+			return nil, 0, wrapErr(ctx, op, err)
+		}
+		users = append(users, usr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, wrapErr(ctx, op, err)
+	}
+
+	return users, total, nil
+}
+
+func (s *Storage) UpdateUser(ctx context.Context, id int64, name string) (*user.User, error) {
+	const op = "storage.postgres.UpdateUser"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-	_, err := s.db.Exec(`INSERT INTO users(name) VALUES ($1);`, name)
+	usr := &user.User{}
+	err := scanUser(s.db.QueryRowContext(ctx, `UPDATE users SET name = $2 WHERE id = $1 RETURNING `+userColumns+`;`, id, name), usr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
 	if err != nil {
 		// handle unique constraint error
 		var pqErr *pq.Error
 		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
-			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
 		}
 
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return nil
+	return usr, nil
 }
 
-func (s *Storage) GetUser(id int64) (*user.User, error) {
-	const op = "storage.postgres.GetUser"
+func (s *Storage) SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (*user.User, error) {
+	const op = "storage.postgres.SetUserAttributes"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-	stmt, err := s.db.Prepare("SELECT * FROM users WHERE id = $1")
+	attrsJSON, err := attributesParam(attrs)
 	if err != nil {
-		return nil, fmt.Errorf("%s: prepare statement: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	row := stmt.QueryRow(id)
-	if row.Err() != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, storage.ErrUserNotFound
-		}
-
-		return nil, fmt.Errorf("%s: execute statement: %w", op, err)
+	usr := &user.User{}
+	err = scanUser(s.db.QueryRowContext(ctx, `
+		UPDATE users SET attributes = $2::JSONB WHERE id = $1 RETURNING `+userColumns+`;
+	`, id, attrsJSON), usr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
 	}
-
-	var usr *user.User
-	err = row.Scan(&usr.ID, &usr.Name)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to scan user name: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
 	return usr, nil
 }
 
-func (s *Storage) DeleteUser(userId string) error {
+func (s *Storage) DeleteUser(ctx context.Context, userID int64) error {
 	const op = "storage.postgres.DeleteUser"
 
-	res, err := s.db.Exec(`DELETE FROM users WHERE id = $1;`, userId)
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// memberships are removed by ON DELETE CASCADE, so they are logged before the user row is gone
+	var deleted int64
+	err := s.db.QueryRowContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM users WHERE id = $1 RETURNING id
+		), logged AS (
+			INSERT INTO user_segments_history(user_id, segment, operation, reason)
+			SELECT usr.user_id, s.slug, $2, $3
+			FROM user_segments AS usr
+			JOIN deleted AS d ON usr.user_id = d.id
+			JOIN segments AS s ON usr.segment_id = s.id
+		)
+		SELECT COUNT(*) FROM deleted;
+	`, userID, history.OperationDelete, history.ReasonUserDeleted).Scan(&deleted)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return wrapErr(ctx, op, err)
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+	if deleted == 0 {
 		return fmt.Errorf("%s: %w", op, storage.ErrUserNotExists)
 	}
 
 	return nil
 }
 
-func (s *Storage) SaveSegment(slug string) error {
+// SaveSegment creates a segment. If percent is positive, the matching share of existing users
+// is enrolled into it right away; users created later are enrolled by SaveUser.
+// It returns the number of users enrolled.
+func (s *Storage) SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error) {
 	const op = "storage.postgres.SaveSegment"
 
-	_, err := s.db.Exec(`INSERT INTO segments(slug) VALUES ($1);`, slug)
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		// handle unique constraint error
-		var pqErr *pq.Error
-		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
-			return fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+		return 0, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if err := lockEnrollment(ctx, tx, seg); err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	if err := insertSegment(ctx, tx, seg); err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	var enrolled int64
+	if seg.Percent > 0 {
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM users;`)
+		if err != nil {
+			return 0, wrapErr(ctx, op, err)
 		}
 
-		return fmt.Errorf("%s: %w", op, err)
+		var userIDs []int64
+		for rows.Next() {
+			var userID int64
+			if err := rows.Scan(&userID); err != nil {
+				rows.Close()
+				return 0, wrapErr(ctx, op, err)
+			}
+			if bucket.Contains(seg.Slug, userID, seg.Percent) {
+				userIDs = append(userIDs, userID)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, wrapErr(ctx, op, err)
+		}
+
+		enrolled, err = enrollUsers(ctx, tx, seg, userIDs)
+		if err != nil {
+			return 0, wrapErr(ctx, op, err)
+		}
 	}
 
-	return nil
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: commit tx: %w", op, err)
+	}
+
+	return enrolled, nil
 }
 
-func (s *Storage) GetSegment(id int64) (*segment.Segment, error) {
-	const op = "storage.postgres.GetSegment"
+// SaveSegmentAsync creates a segment and queues the percent backfill job in the same transaction,
+// so the segment is never left without existing users enrolled.
+func (s *Storage) SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (*job.Job, error) {
+	const op = "storage.postgres.SaveSegmentAsync"
 
-	stmt, err := s.db.Prepare("SELECT id, slug FROM segments WHERE id = $1")
+	payload, err := json.Marshal(job.PercentBackfillPayload{Slug: seg.Slug})
 	if err != nil {
-		return nil, fmt.Errorf("%s: prepare statement: %w", op, err)
+		return nil, fmt.Errorf("%s: encode payload: %w", op, err)
 	}
 
-	row := stmt.QueryRow(id)
-	if row.Err() != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, storage.ErrSegmentNotFound
-		}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if err := lockEnrollment(ctx, tx, seg); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
 
-		return nil, fmt.Errorf("%s: execute statement: %w", op, err)
+	if err := insertSegment(ctx, tx, seg); err != nil {
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	var seg *segment.Segment
-	err = row.Scan(&seg.ID, &seg.Slug)
+	j := &job.Job{}
+	err = scanJob(tx.QueryRowContext(ctx, `
+		INSERT INTO jobs(type, payload) VALUES ($1, $2)
+		RETURNING `+jobColumns+`;
+	`, job.TypePercentBackfill, string(payload)), j)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to scan segment name: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return seg, nil
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: commit tx: %w", op, err)
+	}
+
+	return j, nil
 }
 
-func (s *Storage) GetSegmentBySlug(slug string) (*segment.Segment, error) {
-	const op = "storage.postgres.GetSegmentBySlug"
+// lockEnrollment waits for the users being created to commit before a percentage segment is created,
+// and makes users created meanwhile wait for it, so either the segment enrolls them or they see the segment.
+func lockEnrollment(ctx context.Context, tx *sql.Tx, seg *segment.Segment) error {
+	if seg.Percent <= 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1);`, enrollLockID)
+	return err
+}
+
+// insertSegment stores the segment with the default tags and status and fills its ID and timestamps.
+func insertSegment(ctx context.Context, tx *sql.Tx, seg *segment.Segment) error {
+	if seg.Tags == nil {
+		seg.Tags = []string{}
+	}
+	if seg.Status == "" {
+		seg.Status = segment.StatusActive
+	}
 
-	stmt, err := s.db.Prepare("SELECT id, slug FROM segments WHERE slug = $1")
+	rule, err := ruleParam(seg.Rule)
 	if err != nil {
-		return nil, fmt.Errorf("%s: prepare statement: %w", op, err)
+		return err
 	}
 
-	row := stmt.QueryRow(slug)
-	if row.Err() != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, storage.ErrSegmentNotFound
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO segments(slug, percent, description, owner, tags, status, rule) VALUES ($1, $2, $3, $4, $5, $6, $7::JSONB)
+		RETURNING id, created_at, updated_at;
+	`, seg.Slug, seg.Percent, seg.Description, seg.Owner, pq.Array(seg.Tags), seg.Status, rule).Scan(&seg.ID, &seg.CreatedAt, &seg.UpdatedAt)
+	if err != nil {
+		// handle unique constraint error
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return storage.ErrSegmentExists
 		}
 
-		return nil, fmt.Errorf("%s: execute statement: %w", op, err)
+		return err
 	}
 
-	seg := &segment.Segment{}
-	err = row.Scan(&seg.ID, &seg.Slug)
+	return nil
+}
+
+// BackfillSegmentPercent enrolls the users with ids after afterUserID which fall into the percentage segment,
+// scanning at most limit users ordered by id in one transaction. The next page starts after LastUserID
+// of the returned one, and a page with no users scanned means the backfill is done. Existing memberships
+// are skipped, so a page may be repeated after a failure.
+func (s *Storage) BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (*storage.BackfillPage, error) {
+	const op = "storage.postgres.BackfillSegmentPercent"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("%s: failed to scan segment name: %w", op, err)
+		return nil, fmt.Errorf("%s: begin tx: %w", op, err)
 	}
+	defer tx.Rollback()
 
-	return seg, nil
-}
-
-func (s *Storage) GetSegments() ([]*segment.Segment, error) {
-	const op = "storage.postgres.GetSegments"
+	seg, err := getSegmentBySlug(ctx, tx, slug)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
 
-	rows, err := s.db.Query(`SELECT id, slug FROM segments`)
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT $2;`, afterUserID, limit)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
-	defer rows.Close()
 
-	var segments []*segment.Segment
+	page := &storage.BackfillPage{}
+	var userIDs []int64
 	for rows.Next() {
-		seg := &segment.Segment{}
-		if err := rows.Scan(&seg.ID, &seg.Slug); err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
+		if err := rows.Scan(&page.LastUserID); err != nil {
+			rows.Close()
+			return nil, wrapErr(ctx, op, err)
+		}
+		page.Scanned++
+		if bucket.Contains(seg.Slug, page.LastUserID, seg.Percent) {
+			userIDs = append(userIDs, page.LastUserID)
 		}
-		segments = append(segments, seg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return segments, nil
-}
-
-func (s *Storage) DeleteSegment(segmentId string) error {
-	const op = "storage.postgres.DeleteSegment"
-
-	res, err := s.db.Exec(`DELETE FROM segments WHERE id = $1;`, segmentId)
+	page.Enrolled, err = enrollUsers(ctx, tx, seg, userIDs)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotExists)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: commit tx: %w", op, err)
 	}
 
-	return nil
+	return page, nil
 }
 
-func (s *Storage) DeleteSegmentBySlug(slug string) error {
-	const op = "storage.postgres.DeleteSegmentBySlug"
-
-	res, err := s.db.Exec(`DELETE FROM segments WHERE slug = $1;`, slug)
-	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+// enrollUsers adds the users to the percentage segment, skipping existing memberships,
+// and returns the number of memberships created.
+func enrollUsers(ctx context.Context, tx *sql.Tx, seg *segment.Segment, userIDs []int64) (int64, error) {
+	if len(userIDs) == 0 {
+		return 0, nil
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotExists)
+	res, err := tx.ExecContext(ctx, `
+		WITH inserted AS (
+			INSERT INTO user_segments(user_id, segment_id, source)
+			SELECT unnest($1::BIGINT[]), $2, $5
+			ON CONFLICT (user_id, segment_id) DO NOTHING
+			RETURNING user_id
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason)
+		SELECT user_id, $3, $4, $5 FROM inserted;
+	`, pq.Array(userIDs), seg.ID, seg.Slug, history.OperationAdd, history.ReasonAuto)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return res.RowsAffected()
 }
 
-func (s *Storage) AddUserSegments(userID int64, segmentIDs []int64) error {
-	const op = "storage.postgres.AddUserSegments"
+func (s *Storage) GetSegmentBySlug(ctx context.Context, slug string) (*segment.Segment, error) {
+	const op = "storage.postgres.GetSegmentBySlug"
 
-	for _, segmentID := range segmentIDs {
-		_, err := s.db.Exec(`INSERT INTO user_segments(user_id, segment_id) VALUES ($1, $2);`, userID, segmentID)
-		if err != nil {
-			// handle unique constraint error
-			var pqErr *pq.Error
-			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
-				return fmt.Errorf("%s: %w", op, storage.ErrUserAlreadyHaveSegment)
-			}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-			return fmt.Errorf("%s: %w", op, err)
-		}
+	seg := &segment.Segment{}
+	err := scanSegment(s.db.QueryRowContext(ctx, `SELECT `+segmentColumns+` FROM segments WHERE slug = $1;`, slug), seg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	return nil
+	return seg, nil
 }
 
-func (s *Storage) AddUserSegmentsBySlugs(userID int64, segmentsToAdd []users.SegmentRequest) error {
-	const op = "storage.postgres.AddUserSegmentsBySlugs"
+// segmentSortColumns maps segment sort orders to columns and the types of their cursor values.
+var segmentSortColumns = map[string]struct{ column, typ string }{
+	storage.SortSegmentsBySlug:      {"slug", "TEXT"},
+	storage.SortSegmentsByCreatedAt: {"created_at", "TIMESTAMPTZ"},
+	storage.SortSegmentsByUpdatedAt: {"updated_at", "TIMESTAMPTZ"},
+}
 
-	for _, segmentToAdd := range segmentsToAdd {
-		seg, err := s.GetSegmentBySlug(segmentToAdd.Slug)
-		if err != nil {
-			continue
-		}
+func (s *Storage) GetSegments(ctx context.Context, filter storage.SegmentFilter) ([]*segment.Segment, int64, error) {
+	const op = "storage.postgres.GetSegments"
 
-		_, err = s.db.Exec(`
-			INSERT INTO user_segments(user_id, segment_id, delete_at) VALUES ($1, $2, $3);
-		`, userID, seg.ID, segmentToAdd.DeleteAt)
-		if err != nil {
-			// handle unique constraint error
-			var pqErr *pq.Error
-			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
-				return fmt.Errorf("%s: %w", op, storage.ErrUserAlreadyHaveSegment)
-			}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-			return fmt.Errorf("%s: %w", op, err)
-		}
+	var (
+		where []string
+		args  []any
+	)
+	// cond formats the condition with the placeholder of arg
+	cond := func(format string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(format, len(args)))
 	}
 
-	return nil
-}
+	if filter.Query != "" {
+		cond("slug ILIKE $%d", "%"+escapeLike(filter.Query)+"%")
+	}
+	if filter.Prefix != "" {
+		cond("slug LIKE $%d", escapeLike(filter.Prefix)+"%")
+	}
+	if len(filter.Tags) > 0 {
+		cond("tags @> $%d", pq.Array(filter.Tags))
+	}
+	if filter.Owner != "" {
+		cond("owner = $%d", filter.Owner)
+	}
+	if filter.Status != "" {
+		cond("status = $%d", filter.Status)
+	}
 
-func (s *Storage) DeleteUserSegmentsBySlugs(userID int64, slugs []string) error {
-	const op = "storage.postgres.DeleteUserSegmentsBySlugs"
+	whereSQL := ""
+	if len(where) > 0 {
+		whereSQL = "WHERE " + strings.Join(where, " AND ")
+	}
 
-	for _, slug := range slugs {
-		seg, err := s.GetSegmentBySlug(slug)
-		if err != nil {
-			continue
-		}
+	var total int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM segments `+whereSQL+`;`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, wrapErr(ctx, op, err)
+	}
 
-		_, err = s.db.Exec(`DELETE FROM user_segments WHERE user_id = $1 AND segment_id = $2;`, userID, seg.ID)
-		if err != nil {
-			return fmt.Errorf("%s: %w", op, err)
-		}
+	cmp, dir := ">", "ASC"
+	if filter.Desc {
+		cmp, dir = "<", "DESC"
 	}
 
-	return nil
-}
+	orderBy := "id " + dir
+	sortColumn, sortByColumn := segmentSortColumns[filter.Sort]
+	if sortByColumn {
+		orderBy = sortColumn.column + " " + dir + ", " + orderBy
+	}
 
-func (s *Storage) GetUserSegments(userID int64) ([]*segment.Segment, error) {
-	const op = "storage.postgres.GetUserSegments"
+	if filter.After != nil {
+		if sortByColumn {
+			args = append(args, filter.After.Value, filter.After.ID)
+			where = append(where, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)",
+				sortColumn.column, cmp, len(args)-1, sortColumn.typ, len(args)))
+		} else {
+			cond("id "+cmp+" $%d", filter.After.ID)
+		}
+
+		whereSQL = "WHERE " + strings.Join(where, " AND ")
+	}
 
-	rows, err := s.db.Query(`
-        SELECT s.id, s.slug
-        FROM user_segments AS usr
-        JOIN segments AS s ON usr.segment_id = s.id
-        WHERE usr.user_id = $1;
-    `, userID)
+	args = append(args, filter.Limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT `+segmentColumns+` FROM segments
+		%s
+		ORDER BY %s
+		LIMIT $%d;
+	`, whereSQL, orderBy, len(args)), args...)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, 0, wrapErr(ctx, op, err)
 	}
+	defer rows.Close()
 
-	var segments []*segment.Segment
+	segments := make([]*segment.Segment, 0, filter.Limit)
 	for rows.Next() {
 		seg := &segment.Segment{}
-		if err := rows.Scan(&seg.ID, &seg.Slug); err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
+		if err := scanSegment(rows, seg); err != nil {
+			return nil, 0, wrapErr(ctx, op, err)
 		}
 		segments = append(segments, seg)
 	}
 
-	return segments, nil
+	if err := rows.Err(); err != nil {
+		return nil, 0, wrapErr(ctx, op, err)
+	}
+
+	return segments, total, nil
 }
 
-func (s *Storage) ConfigureUserSegments(userID int64, segAdd []users.SegmentRequest, segDel []string) error {
-	// TODO: tx
-	const op = "storage.postgres.ConfigureUserSegments"
+func (s *Storage) UpdateSegment(ctx context.Context, slug string, upd storage.SegmentUpdate) (*segment.Segment, error) {
+	const op = "storage.postgres.UpdateSegment"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-	err := s.AddUserSegmentsBySlugs(userID, segAdd)
+	var rule any
+	if upd.Rule != nil {
+		var err error
+		if rule, err = ruleParam(*upd.Rule); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	// a nil tags slice is passed as NULL and keeps the current tags, the rule is only set if $6 is true,
+	// since NULL also clears it
+	seg := &segment.Segment{}
+	err := scanSegment(s.db.QueryRowContext(ctx, `
+		UPDATE segments SET
+			description = COALESCE($2, description),
+			owner = COALESCE($3, owner),
+			tags = COALESCE($4::TEXT[], tags),
+			status = COALESCE($5, status),
+			rule = CASE WHEN $6 THEN $7::JSONB ELSE rule END,
+			updated_at = NOW()
+		WHERE slug = $1
+		RETURNING `+segmentColumns+`;
+	`, slug, upd.Description, upd.Owner, pq.Array(upd.Tags), upd.Status, upd.Rule != nil, rule), seg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
 	if err != nil {
-		return fmt.Errorf("%s: failed to add segments to user: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	err = s.DeleteUserSegmentsBySlugs(userID, segDel)
+	return seg, nil
+}
+
+func (s *Storage) DeleteSegmentBySlug(ctx context.Context, slug string) error {
+	const op = "storage.postgres.DeleteSegmentBySlug"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// memberships are removed by ON DELETE CASCADE, so they are logged before the segment row is gone
+	var deleted int64
+	err := s.db.QueryRowContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM segments WHERE slug = $1 RETURNING id, slug
+		), logged AS (
+			INSERT INTO user_segments_history(user_id, segment, operation, reason)
+			SELECT usr.user_id, d.slug, $2, $3
+			FROM user_segments AS usr
+			JOIN deleted AS d ON usr.segment_id = d.id
+		)
+		SELECT COUNT(*) FROM deleted;
+	`, slug, history.OperationDelete, history.ReasonSegmentDeleted).Scan(&deleted)
 	if err != nil {
-		return fmt.Errorf("%s: failed to delete segments from user: %w", op, err)
+		return wrapErr(ctx, op, err)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotExists)
 	}
 
 	return nil
 }
 
-func (s *Storage) DeleteSegmentsTTL() (int64, error) {
-	const op = "storage.postgres.DeleteSegmentsTTL"
+func (s *Storage) GetSegmentMembers(ctx context.Context, slug string, filter storage.MemberFilter) ([]*segment.Member, error) {
+	const op = "storage.postgres.GetSegmentMembers"
 
-	currentTime := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-	res, err := s.db.Exec(`
-		DELETE FROM user_segments 
-		WHERE delete_at IS NOT NULL AND delete_at < $1
-	`, currentTime)
+	segmentID, err := s.segmentID(ctx, slug)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
 
-	deleted, err := res.RowsAffected()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT us.user_id, u.name, us.delete_at
+		FROM user_segments AS us
+		JOIN users AS u ON us.user_id = u.id
+		WHERE us.segment_id = $1 AND us.user_id > $2
+			AND ($3::TIMESTAMP IS NULL OR us.delete_at < $3)
+		ORDER BY us.user_id
+		LIMIT $4;
+	`, segmentID, filter.AfterUserID, utcTime(filter.ExpiringBefore), filter.Limit)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return nil, wrapErr(ctx, op, err)
 	}
+	defer rows.Close()
 
-	return deleted, nil
+	members := make([]*segment.Member, 0, filter.Limit)
+	for rows.Next() {
+		member := &segment.Member{}
+		if err := rows.Scan(&member.UserID, &member.Name, &member.DeleteAt); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return members, nil
+}
+
+func (s *Storage) GetSegmentStats(ctx context.Context, slug string) (*segment.Stats, error) {
+	const op = "storage.postgres.GetSegmentStats"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	stats := &segment.Stats{Slug: slug}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(us.user_id), COUNT(us.delete_at)
+		FROM segments AS s
+		LEFT JOIN user_segments AS us ON us.segment_id = s.id
+		WHERE s.slug = $1
+		GROUP BY s.id;
+	`, slug).Scan(&stats.Members, &stats.Expiring)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return stats, nil
+}
+
+// bulkBatchSize is the number of users changed by a single statement of a bulk membership change.
+const bulkBatchSize = 1000
+
+// AddSegmentUsers adds users to the segment in batches, every batch is committed separately
+// and limited by the query timeout. On error the result holds the batches committed so far.
+func (s *Storage) AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (*storage.BulkResult, error) {
+	const op = "storage.postgres.AddSegmentUsers"
+
+	segmentID, err := s.segmentID(ctx, slug)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	result := &storage.BulkResult{}
+	seen := make(map[int64]struct{}, len(members))
+
+	var batch []storage.BulkMember
+	for i, member := range members {
+		if _, ok := seen[member.UserID]; ok {
+			result.Fail(member.UserID, storage.BulkFailureDuplicate)
+		} else {
+			seen[member.UserID] = struct{}{}
+			batch = append(batch, member)
+		}
+
+		if len(batch) < bulkBatchSize && i < len(members)-1 {
+			continue
+		}
+
+		if err := s.addSegmentUsersBatch(ctx, segmentID, slug, batch, result); err != nil {
+			return result, wrapErr(ctx, op, err)
+		}
+		batch = batch[:0]
+	}
+
+	return result, nil
+}
+
+func (s *Storage) addSegmentUsersBatch(ctx context.Context, segmentID int64, slug string, batch []storage.BulkMember, result *storage.BulkResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	userIDs := make([]int64, len(batch))
+	// times are passed as text, pq does not quote them inside arrays
+	deleteAts := make([]sql.NullString, len(batch))
+	for i, member := range batch {
+		userIDs[i] = member.UserID
+		if member.DeleteAt != nil {
+			deleteAts[i] = sql.NullString{String: member.DeleteAt.UTC().Format(time.RFC3339Nano), Valid: true}
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH input AS (
+			SELECT * FROM unnest($1::BIGINT[], $2::TEXT[]) AS t(user_id, delete_at)
+		), inserted AS (
+			INSERT INTO user_segments(user_id, segment_id, delete_at, source)
+			SELECT i.user_id, $3, i.delete_at::TIMESTAMP, $6 FROM input AS i JOIN users AS u ON u.id = i.user_id
+			ON CONFLICT (user_id, segment_id) DO NOTHING
+			RETURNING user_id, delete_at
+		), logged AS (
+			INSERT INTO user_segments_history(user_id, segment, operation, reason, delete_at)
+			SELECT user_id, $4, $5, $6, delete_at FROM inserted
+		)
+		SELECT i.user_id, u.id IS NOT NULL, ins.user_id IS NOT NULL
+		FROM input AS i
+		LEFT JOIN users AS u ON u.id = i.user_id
+		LEFT JOIN inserted AS ins ON ins.user_id = i.user_id;
+	`, pq.Array(userIDs), pq.Array(deleteAts), segmentID, slug, history.OperationAdd, history.ReasonBulk)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		added    int64
+		failures []storage.BulkFailure
+	)
+	for rows.Next() {
+		var (
+			userID            int64
+			userExists, isNew bool
+		)
+		if err := rows.Scan(&userID, &userExists, &isNew); err != nil {
+			return err
+		}
+
+		switch {
+		case isNew:
+			added++
+		case !userExists:
+			failures = append(failures, storage.BulkFailure{UserID: userID, Reason: storage.BulkFailureUserNotFound})
+		default:
+			failures = append(failures, storage.BulkFailure{UserID: userID, Reason: storage.BulkFailureAlreadyMember})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the statement is committed on its own, count it only when it succeeded
+	result.Changed += added
+	result.Failed = append(result.Failed, failures...)
+
+	return nil
+}
+
+// RemoveSegmentUsers removes users from the segment in batches, see AddSegmentUsers.
+func (s *Storage) RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*storage.BulkResult, error) {
+	const op = "storage.postgres.RemoveSegmentUsers"
+
+	segmentID, err := s.segmentID(ctx, slug)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	result := &storage.BulkResult{}
+	seen := make(map[int64]struct{}, len(userIDs))
+
+	var batch []int64
+	for i, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			result.Fail(userID, storage.BulkFailureDuplicate)
+		} else {
+			seen[userID] = struct{}{}
+			batch = append(batch, userID)
+		}
+
+		if len(batch) < bulkBatchSize && i < len(userIDs)-1 {
+			continue
+		}
+
+		if err := s.removeSegmentUsersBatch(ctx, segmentID, slug, batch, result); err != nil {
+			return result, wrapErr(ctx, op, err)
+		}
+		batch = batch[:0]
+	}
+
+	return result, nil
+}
+
+func (s *Storage) removeSegmentUsersBatch(ctx context.Context, segmentID int64, slug string, batch []int64, result *storage.BulkResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM user_segments
+			WHERE segment_id = $1 AND user_id = ANY($2::BIGINT[])
+			RETURNING user_id
+		), logged AS (
+			INSERT INTO user_segments_history(user_id, segment, operation, reason)
+			SELECT user_id, $3, $4, $5 FROM deleted
+		)
+		SELECT user_id FROM deleted;
+	`, segmentID, pq.Array(batch), slug, history.OperationDelete, history.ReasonBulk)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	removed := make(map[int64]struct{}, len(batch))
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+		removed[userID] = struct{}{}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	result.Changed += int64(len(removed))
+	for _, userID := range batch {
+		if _, ok := removed[userID]; !ok {
+			result.Fail(userID, storage.BulkFailureNotMember)
+		}
+	}
+
+	return nil
+}
+
+// segmentID returns the id of the segment with the slug.
+func (s *Storage) segmentID(ctx context.Context, slug string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM segments WHERE slug = $1;`, slug).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, storage.ErrSegmentNotFound
+	}
+
+	return id, err
+}
+
+func (s *Storage) GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error) {
+	const op = "storage.postgres.GetUserSegments"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// explicit memberships come first, then the rules of the other segments with the user's attributes,
+	// which are matched here rather than in SQL, the same way as by the memory storage
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT s.id, s.slug, s.percent, NULL::JSONB, NULL::JSONB
+		FROM user_segments AS usr
+		JOIN segments AS s ON usr.segment_id = s.id
+		WHERE usr.user_id = $1
+		UNION ALL
+		SELECT s.id, s.slug, s.percent, s.rule, u.attributes
+		FROM segments AS s
+		JOIN users AS u ON u.id = $1
+		WHERE s.rule IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM user_segments AS usr WHERE usr.user_id = $1 AND usr.segment_id = s.id
+		)
+		ORDER BY 1;
+	`, userID)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var segments []*segment.Segment
+	for rows.Next() {
+		var (
+			seg            = &segment.Segment{}
+			rule, attrsRaw []byte
+		)
+		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Percent, &rule, &attrsRaw); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+
+		if rule != nil {
+			var attrs user.Attributes
+			if err := json.Unmarshal(rule, &seg.Rule); err != nil {
+				return nil, fmt.Errorf("%s: decode rule: %w", op, err)
+			}
+			if err := json.Unmarshal(attrsRaw, &attrs); err != nil {
+				return nil, fmt.Errorf("%s: decode attributes: %w", op, err)
+			}
+			if !seg.Rule.Match(attrs) {
+				continue
+			}
+		}
+
+		segments = append(segments, seg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return segments, nil
+}
+
+// GetUserSegmentsAt takes the last history record of every segment of the user up to the time.
+// The user had the segment if it is an addition or a TTL update whose delete_at, if any, had not passed yet: expired
+// memberships are removed by the TTL sweep a bit later. delete_at of records written before it was
+// kept in the history is unknown, for them the sweep time is used.
+func (s *Storage) GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) ([]string, error) {
+	const op = "storage.postgres.GetUserSegmentsAt"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// delete_at is stored in UTC without a time zone (see utcTime)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT segment FROM (
+			SELECT DISTINCT ON (segment) segment, operation, delete_at
+			FROM user_segments_history
+			WHERE user_id = $1 AND created_at <= $2
+			ORDER BY segment, created_at DESC, id DESC
+		) AS last
+		WHERE operation IN ($3, $4) AND (delete_at IS NULL OR delete_at > $2 AT TIME ZONE 'UTC')
+		ORDER BY segment;
+	`, userID, at, history.OperationAdd, history.OperationUpdate)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	slugs := []string{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		slugs = append(slugs, slug)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return slugs, nil
+}
+
+// ConfigureUserSegments adds and deletes the user's segments in a single transaction.
+// Either every change is applied or none: if any segment is rejected, the transaction is
+// rolled back and the result lists only the rejected segments.
+// Unknown segments are rejected unless lenient is set, in which case they are skipped.
+func (s *Storage) ConfigureUserSegments(ctx context.Context, userID int64, segAdd []storage.SegmentToAdd, segDel []string, lenient bool) (*storage.ConfigureResult, error) {
+	const op = "storage.postgres.ConfigureUserSegments"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// lock the user, so concurrent configurations of the same user are applied one after another
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE;`, userID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	result := &storage.ConfigureResult{}
+
+	toDelete := make(map[string]struct{}, len(segDel))
+	for _, slug := range segDel {
+		toDelete[slug] = struct{}{}
+	}
+
+	for _, segmentToAdd := range segAdd {
+		if _, ok := toDelete[segmentToAdd.Slug]; ok {
+			result.Reject(segmentToAdd.Slug, storage.RejectReasonConflict)
+			continue
+		}
+
+		err := addUserSegment(ctx, tx, userID, segmentToAdd, lenient, result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to add segment to user: %w", op, err)
+		}
+	}
+
+	for _, slug := range segDel {
+		err := deleteUserSegment(ctx, tx, userID, slug, lenient, result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to delete segment from user: %w", op, err)
+		}
+	}
+
+	if len(result.Rejected) > 0 {
+		rejected := &storage.ConfigureResult{Rejected: result.Rejected}
+		if len(rejected.Unknown()) > 0 {
+			return rejected, fmt.Errorf("%s: %w: %w", op, storage.ErrSegmentsRejected, storage.ErrSegmentNotFound)
+		}
+
+		return rejected, fmt.Errorf("%s: %w", op, storage.ErrSegmentsRejected)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: commit tx: %w", op, err)
+	}
+
+	return result, nil
+}
+
+func addUserSegment(ctx context.Context, tx *sql.Tx, userID int64, segmentToAdd storage.SegmentToAdd, lenient bool, result *storage.ConfigureResult) error {
+	seg, err := getSegmentBySlug(ctx, tx, segmentToAdd.Slug)
+	if errors.Is(err, storage.ErrSegmentNotFound) {
+		skipUnknownSegment(segmentToAdd.Slug, lenient, result)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		WITH inserted AS (
+			INSERT INTO user_segments(user_id, segment_id, delete_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, segment_id) DO NOTHING
+			RETURNING user_id, delete_at
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason, delete_at)
+		SELECT user_id, $4, $5, $6, delete_at FROM inserted;
+	`, userID, seg.ID, utcTime(segmentToAdd.DeleteAt), seg.Slug, history.OperationAdd, history.ReasonManual)
+	if err != nil {
+		return err
+	}
+
+	if added, _ := res.RowsAffected(); added == 0 {
+		result.Reject(seg.Slug, storage.RejectReasonAlreadyMember)
+		return nil
+	}
+
+	result.Added = append(result.Added, seg.Slug)
+
+	return nil
+}
+
+func deleteUserSegment(ctx context.Context, tx *sql.Tx, userID int64, slug string, lenient bool, result *storage.ConfigureResult) error {
+	seg, err := getSegmentBySlug(ctx, tx, slug)
+	if errors.Is(err, storage.ErrSegmentNotFound) {
+		skipUnknownSegment(slug, lenient, result)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM user_segments WHERE user_id = $1 AND segment_id = $2 RETURNING user_id
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason)
+		SELECT user_id, $3, $4, $5 FROM deleted;
+	`, userID, seg.ID, seg.Slug, history.OperationDelete, history.ReasonManual)
+	if err != nil {
+		return err
+	}
+
+	if deleted, _ := res.RowsAffected(); deleted > 0 {
+		result.Removed = append(result.Removed, seg.Slug)
+	}
+
+	return nil
+}
+
+// SetUserSegments applies the difference between the user's explicit memberships and segments in a single transaction.
+// Repeating the call changes nothing, so it is safe to retry.
+func (s *Storage) SetUserSegments(ctx context.Context, userID int64, segments []storage.SegmentToAdd, lenient bool) (*storage.ConfigureResult, error) {
+	const op = "storage.postgres.SetUserSegments"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// lock the user, so concurrent configurations of the same user are applied one after another
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE;`, userID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	result := &storage.ConfigureResult{}
+
+	keep := make([]int64, 0, len(segments))
+	for _, segmentToSet := range segments {
+		seg, err := getSegmentBySlug(ctx, tx, segmentToSet.Slug)
+		if errors.Is(err, storage.ErrSegmentNotFound) {
+			skipUnknownSegment(segmentToSet.Slug, lenient, result)
+			continue
+		}
+		if err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		keep = append(keep, seg.ID)
+
+		if err := setUserSegment(ctx, tx, userID, seg, utcTime(segmentToSet.DeleteAt), result); err != nil {
+			return nil, fmt.Errorf("%s: failed to set user segment: %w", op, err)
+		}
+	}
+
+	if len(result.Rejected) > 0 {
+		rejected := &storage.ConfigureResult{Rejected: result.Rejected}
+		return rejected, fmt.Errorf("%s: %w: %w", op, storage.ErrSegmentsRejected, storage.ErrSegmentNotFound)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM user_segments AS usr
+			USING segments AS s
+			WHERE usr.segment_id = s.id AND usr.user_id = $1 AND NOT (usr.segment_id = ANY($2::BIGINT[]))
+				AND usr.source <> $5
+			RETURNING usr.user_id, s.slug
+		), logged AS (
+			INSERT INTO user_segments_history(user_id, segment, operation, reason)
+			SELECT user_id, slug, $3, $4 FROM deleted
+		)
+		SELECT slug FROM deleted ORDER BY slug;
+	`, userID, pq.Array(keep), history.OperationDelete, history.ReasonManual, history.ReasonAuto)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		result.Removed = append(result.Removed, slug)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: commit tx: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// setUserSegment adds the segment to the user or updates delete_at of the existing membership,
+// which becomes manual, so it is removed once it is missing from the list.
+func setUserSegment(ctx context.Context, tx *sql.Tx, userID int64, seg *segment.Segment, deleteAt *time.Time, result *storage.ConfigureResult) error {
+	res, err := tx.ExecContext(ctx, `
+		WITH inserted AS (
+			INSERT INTO user_segments(user_id, segment_id, delete_at) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, segment_id) DO NOTHING
+			RETURNING user_id, delete_at
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason, delete_at)
+		SELECT user_id, $4, $5, $6, delete_at FROM inserted;
+	`, userID, seg.ID, deleteAt, seg.Slug, history.OperationAdd, history.ReasonManual)
+	if err != nil {
+		return err
+	}
+
+	if added, _ := res.RowsAffected(); added > 0 {
+		result.Added = append(result.Added, seg.Slug)
+		return nil
+	}
+
+	// taking over the membership changes nothing the user sees, so it is not recorded in the history
+	_, err = tx.ExecContext(ctx, `
+		UPDATE user_segments SET source = $3 WHERE user_id = $1 AND segment_id = $2 AND source <> $3;
+	`, userID, seg.ID, history.ReasonManual)
+	if err != nil {
+		return err
+	}
+
+	res, err = tx.ExecContext(ctx, `
+		WITH updated AS (
+			UPDATE user_segments SET delete_at = $3
+			WHERE user_id = $1 AND segment_id = $2 AND delete_at IS DISTINCT FROM $3::TIMESTAMP
+			RETURNING user_id, delete_at
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason, delete_at)
+		SELECT user_id, $4, $5, $6, delete_at FROM updated;
+	`, userID, seg.ID, deleteAt, seg.Slug, history.OperationUpdate, history.ReasonManual)
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := res.RowsAffected(); updated > 0 {
+		result.Updated = append(result.Updated, seg.Slug)
+	}
+
+	return nil
+}
+
+func skipUnknownSegment(slug string, lenient bool, result *storage.ConfigureResult) {
+	if lenient {
+		result.Ignored = append(result.Ignored, slug)
+		return
+	}
+
+	result.Reject(slug, storage.RejectReasonNotFound)
+}
+
+func getSegmentBySlug(ctx context.Context, tx *sql.Tx, slug string) (*segment.Segment, error) {
+	seg := &segment.Segment{}
+	err := tx.QueryRowContext(ctx, `SELECT id, slug, percent FROM segments WHERE slug = $1;`, slug).Scan(&seg.ID, &seg.Slug, &seg.Percent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrSegmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return seg, nil
+}
+
+func (s *Storage) DeleteSegmentsTTL(ctx context.Context) (int64, error) {
+	const op = "storage.postgres.DeleteSegmentsTTL"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	currentTime := time.Now().UTC()
+
+	res, err := s.db.ExecContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM user_segments
+			WHERE delete_at IS NOT NULL AND delete_at < $1
+			RETURNING user_id, segment_id
+		)
+		INSERT INTO user_segments_history(user_id, segment, operation, reason)
+		SELECT d.user_id, s.slug, $2, $3
+		FROM deleted AS d
+		JOIN segments AS s ON d.segment_id = s.id;
+	`, currentTime, history.OperationDelete, history.ReasonTTL)
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) GetUserHistory(ctx context.Context, userID int64, from, to time.Time) ([]*history.Record, error) {
+	const op = "storage.postgres.GetUserHistory"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, segment, operation, reason, delete_at, created_at
+		FROM user_segments_history
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at, id;
+	`, userID, from, to)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var records []*history.Record
+	for rows.Next() {
+		rec := &history.Record{}
+		if err := rows.Scan(&rec.ID, &rec.UserID, &rec.Segment, &rec.Operation, &rec.Reason, &rec.DeleteAt, &rec.CreatedAt); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		records = append(records, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return records, nil
+}
+
+func (s *Storage) SaveAPIKey(ctx context.Context, name, role, hash string) (*apikey.APIKey, error) {
+	const op = "storage.postgres.SaveAPIKey"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	key := &apikey.APIKey{Name: name, Role: role}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO api_keys(name, key_hash, role) VALUES ($1, $2, $3)
+		RETURNING id, created_at;
+	`, name, hash, role).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return key, nil
+}
+
+func (s *Storage) GetAPIKeyByHash(ctx context.Context, hash string) (*apikey.APIKey, error) {
+	const op = "storage.postgres.GetAPIKeyByHash"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	key := &apikey.APIKey{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, name, role, created_at, revoked_at FROM api_keys WHERE key_hash = $1;
+	`, hash).Scan(&key.ID, &key.Name, &key.Role, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return key, nil
+}
+
+func (s *Storage) GetAPIKeys(ctx context.Context) ([]*apikey.APIKey, error) {
+	const op = "storage.postgres.GetAPIKeys"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, role, created_at, revoked_at FROM api_keys ORDER BY id;
+	`)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var keys []*apikey.APIKey
+	for rows.Next() {
+		key := &apikey.APIKey{}
+		if err := rows.Scan(&key.ID, &key.Name, &key.Role, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return keys, nil
+}
+
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) error {
+	const op = "storage.postgres.RevokeAPIKey"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL;
+	`, id)
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+
+	return nil
+}
+
+func (s *Storage) EnqueueJob(ctx context.Context, typ string, payload []byte) (*job.Job, error) {
+	const op = "storage.postgres.EnqueueJob"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	j := &job.Job{}
+	err := scanJob(s.db.QueryRowContext(ctx, `
+		INSERT INTO jobs(type, payload) VALUES ($1, $2)
+		RETURNING `+jobColumns+`;
+	`, typ, string(payload)), j)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return j, nil
+}
+
+func (s *Storage) GetJob(ctx context.Context, id int64) (*job.Job, error) {
+	const op = "storage.postgres.GetJob"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	j := &job.Job{}
+	err := scanJob(s.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = $1;`, id), j)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrJobNotFound)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return j, nil
+}
+
+func (s *Storage) ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (*job.Job, error) {
+	const op = "storage.postgres.ClaimJob"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// workers of these jobs died every time they ran them
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = $1, error = 'lease expired', locked_until = NULL, finished_at = NOW()
+		WHERE status = $2 AND locked_until < NOW() AND attempts >= $3;
+	`, job.StatusFailed, job.StatusRunning, maxAttempts)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	j := &job.Job{}
+	err = scanJob(s.db.QueryRowContext(ctx, `
+		UPDATE jobs SET
+			status = $1,
+			attempts = attempts + 1,
+			locked_until = NOW() + make_interval(secs => $2),
+			started_at = COALESCE(started_at, NOW())
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = $3 OR (status = $1 AND locked_until < NOW())
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns+`;
+	`, job.StatusRunning, lease.Seconds(), job.StatusQueued), j)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return j, nil
+}
+
+func (s *Storage) UpdateJobProgress(ctx context.Context, j *job.Job, lease time.Duration) error {
+	const op = "storage.postgres.UpdateJobProgress"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET
+			progress_done = $1, progress_total = $2, result = $3, locked_until = NOW() + make_interval(secs => $4)
+		WHERE id = $5 AND attempts = $6 AND status = $7;
+	`, j.Progress.Done, j.Progress.Total, jobResult(j), lease.Seconds(), j.ID, j.Attempts, job.StatusRunning)
+
+	return jobAffected(ctx, op, res, err)
+}
+
+func (s *Storage) FinishJob(ctx context.Context, j *job.Job) error {
+	const op = "storage.postgres.FinishJob"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	j.Status = job.StatusSucceeded
+	if j.Error != "" {
+		j.Status = job.StatusFailed
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET
+			status = $1, result = $2, error = $3, progress_done = $4, progress_total = $5,
+			locked_until = NULL, finished_at = NOW()
+		WHERE id = $6 AND attempts = $7 AND status = $8;
+	`, j.Status, jobResult(j), j.Error, j.Progress.Done, j.Progress.Total, j.ID, j.Attempts, job.StatusRunning)
+
+	return jobAffected(ctx, op, res, err)
+}
+
+func (s *Storage) ReleaseJob(ctx context.Context, j *job.Job) error {
+	const op = "storage.postgres.ReleaseJob"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// the interrupted attempt is not counted
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET
+			status = $1, attempts = attempts - 1, progress_done = $2, progress_total = $3, result = $4, locked_until = NULL
+		WHERE id = $5 AND attempts = $6 AND status = $7;
+	`, job.StatusQueued, j.Progress.Done, j.Progress.Total, jobResult(j), j.ID, j.Attempts, job.StatusRunning)
+
+	return jobAffected(ctx, op, res, err)
+}
+
+// jobResult returns the job result to store, NULL for jobs without one.
+// JSON is passed as a string, pq would send []byte as bytea.
+func jobResult(j *job.Job) any {
+	if len(j.Result) == 0 {
+		return nil
+	}
+
+	return string(j.Result)
+}
+
+// jobAffected checks the result of a job update made by the worker holding the job lease.
+func jobAffected(ctx context.Context, op string, res sql.Result, err error) error {
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrJobNotFound)
+	}
+
+	return nil
+}
+
+func (s *Storage) ClaimIdempotencyKey(ctx context.Context, rec *idempotency.Record, lockTimeout time.Duration) (*idempotency.Record, error) {
+	const op = "storage.postgres.ClaimIdempotencyKey"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// an expired record of the key may be left until the next sweep, the key is free then
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE api_key_id = $1 AND key = $2 AND expires_at < NOW();
+	`, rec.APIKeyID, rec.Key)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys(api_key_id, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		ON CONFLICT (api_key_id, key) DO NOTHING;
+	`, rec.APIKeyID, rec.Key, rec.RequestHash, lockTimeout.Seconds())
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	if claimed, _ := res.RowsAffected(); claimed > 0 {
+		return rec, nil
+	}
+
+	stored := &idempotency.Record{APIKeyID: rec.APIKeyID, Key: rec.Key}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT request_hash, status_code, content_type, body
+		FROM idempotency_keys
+		WHERE api_key_id = $1 AND key = $2;
+	`, rec.APIKeyID, rec.Key).Scan(&stored.RequestHash, &stored.StatusCode, &stored.ContentType, &stored.Body)
+	if err != nil {
+		// sql.ErrNoRows means the key expired right after the insert, the request may be retried
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return stored, fmt.Errorf("%s: %w", op, storage.ErrIdempotencyKeyExists)
+}
+
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	const op = "storage.postgres.DeleteExpiredIdempotencyKeys"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < NOW();`)
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, rec *idempotency.Record, ttl time.Duration) error {
+	const op = "storage.postgres.CompleteIdempotencyKey"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET
+			status_code = $1, content_type = $2, body = $3, expires_at = NOW() + make_interval(secs => $4)
+		WHERE api_key_id = $5 AND key = $6;
+	`, rec.StatusCode, rec.ContentType, rec.Body, ttl.Seconds(), rec.APIKeyID, rec.Key)
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string) error {
+	const op = "storage.postgres.DeleteIdempotencyKey"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE api_key_id = $1 AND key = $2;`, apiKeyID, key)
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) SaveWebhook(ctx context.Context, url, secret string) (*webhook.Webhook, error) {
+	const op = "storage.postgres.SaveWebhook"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	wh := &webhook.Webhook{URL: url, Secret: secret}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO webhooks(url, secret) VALUES ($1, $2) RETURNING id, created_at;
+	`, url, secret).Scan(&wh.ID, &wh.CreatedAt)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return wh, nil
+}
+
+func (s *Storage) GetWebhooks(ctx context.Context) ([]*webhook.Webhook, error) {
+	const op = "storage.postgres.GetWebhooks"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT w.id, w.url, w.created_at,
+			COUNT(d.id) FILTER (WHERE d.status = $1),
+			COUNT(d.id) FILTER (WHERE d.status = $2)
+		FROM webhooks AS w
+		LEFT JOIN webhook_deliveries AS d ON d.webhook_id = w.id
+		GROUP BY w.id
+		ORDER BY w.id;
+	`, webhook.DeliveryPending, webhook.DeliveryFailed)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var webhooks []*webhook.Webhook
+	for rows.Next() {
+		wh := &webhook.Webhook{}
+		if err := rows.Scan(&wh.ID, &wh.URL, &wh.CreatedAt, &wh.Pending, &wh.Failed); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		webhooks = append(webhooks, wh)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return webhooks, nil
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) error {
+	const op = "storage.postgres.DeleteWebhook"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	// deliveries are deleted by ON DELETE CASCADE
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1;`, id)
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+
+	return nil
+}
+
+// FanOutOutboxEvents takes the oldest events, so instances fanning out concurrently skip each other's events.
+func (s *Storage) FanOutOutboxEvents(ctx context.Context, limit int) (int, error) {
+	const op = "storage.postgres.FanOutOutboxEvents"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: begin tx: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, user_id, segment, operation, reason, delete_at, created_at
+		FROM outbox_events
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED;
+	`, limit)
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	var (
+		ids      []int64
+		types    []string
+		payloads []string
+	)
+	for rows.Next() {
+		var (
+			event     webhook.Event
+			operation string
+		)
+		err := rows.Scan(&event.ID, &event.UserID, &event.Segment, &operation, &event.Reason, &event.DeleteAt, &event.OccurredAt)
+		if err != nil {
+			rows.Close()
+			return 0, wrapErr(ctx, op, err)
+		}
+		event.Type = webhook.EventType(operation)
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%s: marshal event: %w", op, err)
+		}
+
+		ids = append(ids, event.ID)
+		types = append(types, event.Type)
+		payloads = append(payloads, string(payload))
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries(webhook_id, event_id, event_type, payload)
+		SELECT w.id, e.id, e.type, e.payload::JSONB
+		FROM webhooks AS w
+		CROSS JOIN unnest($1::BIGINT[], $2::TEXT[], $3::TEXT[]) AS e(id, type, payload)
+		ORDER BY e.id, w.id;
+	`, pq.Array(ids), pq.Array(types), pq.Array(payloads))
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM outbox_events WHERE id = ANY($1);`, pq.Array(ids))
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	return len(ids), nil
+}
+
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*webhook.Delivery, error) {
+	const op = "storage.postgres.ClaimWebhookDeliveries"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE webhook_deliveries AS d SET
+			attempts = d.attempts + 1,
+			locked_until = NOW() + make_interval(secs => $1)
+		FROM webhooks AS w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+			ORDER BY next_attempt_at, id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, w.url, w.secret, d.event_id, d.event_type, d.payload,
+			d.status, d.attempts, d.next_attempt_at, d.last_error;
+	`, lease.Seconds(), webhook.DeliveryPending, limit)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var deliveries []*webhook.Delivery
+	for rows.Next() {
+		d := &webhook.Delivery{}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.EventID, &d.EventType, &d.Payload,
+			&d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError)
+		if err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return deliveries, nil
+}
+
+func (s *Storage) FinishWebhookDelivery(ctx context.Context, d *webhook.Delivery) error {
+	const op = "storage.postgres.FinishWebhookDelivery"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	var err error
+	if d.Status == webhook.DeliveryDelivered {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = $1;`, d.ID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE webhook_deliveries SET
+				status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, locked_until = NULL
+			WHERE id = $5;
+		`, d.Status, d.Attempts, d.NextAttemptAt, d.LastError, d.ID)
+	}
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	return nil
+}
+
+// SaveExperiment looks up the segment of the experiment in the insert, so it may not be deleted meanwhile.
+func (s *Storage) SaveExperiment(ctx context.Context, exp *experiment.Experiment) error {
+	const op = "storage.postgres.SaveExperiment"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	variants, err := json.Marshal(exp.Variants)
+	if err != nil {
+		return fmt.Errorf("%s: encode variants: %w", op, err)
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		WITH audience AS (
+			SELECT id FROM segments WHERE slug = $3
+		)
+		INSERT INTO experiments(slug, description, segment_id, variants)
+		SELECT $1, $2, (SELECT id FROM audience), $4::JSONB
+		WHERE $3 = '' OR EXISTS (SELECT 1 FROM audience)
+		RETURNING id, created_at;
+	`, exp.Slug, exp.Description, exp.Segment, string(variants)).Scan(&exp.ID, &exp.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) {
+			switch pqErr.Code {
+			// unique constraint
+			case "23505":
+				return fmt.Errorf("%s: %w", op, storage.ErrExperimentExists)
+			// the segment was deleted concurrently
+			case "23503":
+				return fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+			}
+		}
+
+		return wrapErr(ctx, op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) GetExperiments(ctx context.Context) ([]*experiment.Experiment, error) {
+	const op = "storage.postgres.GetExperiments"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT e.id, e.slug, e.description, COALESCE(s.slug, ''), e.variants, e.created_at
+		FROM experiments AS e
+		LEFT JOIN segments AS s ON s.id = e.segment_id
+		ORDER BY e.id;
+	`)
+	if err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+	defer rows.Close()
+
+	var experiments []*experiment.Experiment
+	for rows.Next() {
+		var (
+			exp      = &experiment.Experiment{}
+			variants []byte
+		)
+		if err := rows.Scan(&exp.ID, &exp.Slug, &exp.Description, &exp.Segment, &variants, &exp.CreatedAt); err != nil {
+			return nil, wrapErr(ctx, op, err)
+		}
+		if err := json.Unmarshal(variants, &exp.Variants); err != nil {
+			return nil, fmt.Errorf("%s: decode variants: %w", op, err)
+		}
+		experiments = append(experiments, exp)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, op, err)
+	}
+
+	return experiments, nil
+}
+
+func (s *Storage) DeleteExperiment(ctx context.Context, slug string) error {
+	const op = "storage.postgres.DeleteExperiment"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM experiments WHERE slug = $1;`, slug)
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrExperimentNotFound)
+	}
+
+	return nil
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	const op = "storage.postgres.Ping"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return wrapErr(ctx, op, err)
+	}
+
+	return nil
+}
+
+// PendingMigrations returns the number of migrations not applied to the database yet.
+func (s *Storage) PendingMigrations(ctx context.Context) (int, error) {
+	const op = "storage.postgres.PendingMigrations"
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	migrator, err := migrate.New(s.db)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return 0, wrapErr(ctx, op, err)
+	}
+
+	return len(pending), nil
+}
+
+// DB returns the underlying connection pool, e.g. to export its statistics.
+func (s *Storage) DB() *sql.DB {
+	return s.db
+}
+
+// segmentColumns are the segments table columns read by scanSegment.
+const segmentColumns = `id, slug, percent, description, owner, tags, status, rule, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSegment(row scanner, seg *segment.Segment) error {
+	var rule []byte
+	err := row.Scan(&seg.ID, &seg.Slug, &seg.Percent, &seg.Description, &seg.Owner, pq.Array(&seg.Tags), &seg.Status, &rule, &seg.CreatedAt, &seg.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	if seg.Tags == nil {
+		seg.Tags = []string{}
+	}
+
+	if rule != nil {
+		if err := json.Unmarshal(rule, &seg.Rule); err != nil {
+			return fmt.Errorf("decode rule: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ruleParam encodes the rule for a JSONB parameter, an empty rule is NULL.
+func ruleParam(rule segment.Rule) (any, error) {
+	if len(rule) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, fmt.Errorf("encode rule: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// userColumns are the users table columns read by scanUser.
+const userColumns = `id, name, attributes`
+
+func scanUser(row scanner, usr *user.User) error {
+	var attrs []byte
+	if err := row.Scan(&usr.ID, &usr.Name, &attrs); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(attrs, &usr.Attributes); err != nil {
+		return fmt.Errorf("decode attributes: %w", err)
+	}
+
+	return nil
+}
+
+// attributesParam encodes the attributes for a JSONB parameter.
+func attributesParam(attrs user.Attributes) (string, error) {
+	if attrs == nil {
+		return "{}", nil
+	}
+
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return "", fmt.Errorf("encode attributes: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// jobColumns are the jobs table columns read by scanJob.
+const jobColumns = `id, type, status, payload, result, error, progress_done, progress_total, attempts, created_at, started_at, finished_at`
+
+func scanJob(row scanner, j *job.Job) error {
+	var payload, result []byte
+	err := row.Scan(&j.ID, &j.Type, &j.Status, &payload, &result, &j.Error,
+		&j.Progress.Done, &j.Progress.Total, &j.Attempts, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if err != nil {
+		return err
+	}
+
+	j.Payload, j.Result = payload, result
+
+	return nil
+}
+
+// wrapErr adds the operation name to err. If the query failed because ctx is done
+// (the request was canceled or the query timed out), the context error is wrapped too,
+// so callers can tell it apart from other failures.
+func wrapErr(ctx context.Context, op string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%s: %w: %w", op, ctxErr, err)
+	}
+
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// utcTime converts t to UTC, since delete_at columns are TIMESTAMP and pq would keep the wall-clock time of t
+// in its own time zone.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	utc := t.UTC()
+	return &utc
+}
+
+// escapeLike escapes LIKE wildcards, so the value is matched literally.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
 }
 
 func (s *Storage) Close() error {
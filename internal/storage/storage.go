@@ -1,6 +1,19 @@
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"avito-test-task-2023/internal/models/apikey"
+	"avito-test-task-2023/internal/models/experiment"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/idempotency"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/segment"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/models/webhook"
+)
 
 var (
 	ErrUserNotFound  = errors.New("user not found")
@@ -12,4 +25,272 @@ var (
 	ErrSegmentNotExists = errors.New("segment not exists")
 
 	ErrUserAlreadyHaveSegment = errors.New("user already have segment")
+	ErrSegmentsRejected       = errors.New("segments rejected")
+
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	ErrJobNotFound = errors.New("job not found")
+
+	ErrIdempotencyKeyExists = errors.New("idempotency key exists")
+
+	ErrWebhookNotFound = errors.New("webhook not found")
+
+	ErrExperimentNotFound = errors.New("experiment not found")
+	ErrExperimentExists   = errors.New("experiment exists")
+)
+
+const (
+	RejectReasonNotFound      = "segment not found"
+	RejectReasonAlreadyMember = "user already has segment"
+	RejectReasonConflict      = "segment is both added and deleted"
 )
+
+const (
+	BulkFailureUserNotFound  = "user not found"
+	BulkFailureAlreadyMember = "user already has segment"
+	BulkFailureNotMember     = "user does not have segment"
+	BulkFailureDuplicate     = "duplicate user id"
+)
+
+// Storage is implemented by every storage backend (see postgres and memory).
+type Storage interface {
+	SaveUser(ctx context.Context, name string, attrs user.Attributes) (*user.User, error)
+	GetUser(ctx context.Context, id int64) (*user.User, error)
+	GetUsers(ctx context.Context, limit, offset int, name string) ([]*user.User, int64, error)
+	UpdateUser(ctx context.Context, id int64, name string) (*user.User, error)
+	// SetUserAttributes replaces all attributes of the user.
+	SetUserAttributes(ctx context.Context, id int64, attrs user.Attributes) (*user.User, error)
+	DeleteUser(ctx context.Context, userID int64) error
+
+	// SaveSegment stores the segment, fills its ID and timestamps and returns the number of users
+	// enrolled into it by percent.
+	SaveSegment(ctx context.Context, seg *segment.Segment) (int64, error)
+	// SaveSegmentAsync stores the segment without enrolling existing users and queues a job.TypePercentBackfill
+	// job enrolling them with BackfillSegmentPercent. The job is queued only if the segment is stored.
+	SaveSegmentAsync(ctx context.Context, seg *segment.Segment) (*job.Job, error)
+	UpdateSegment(ctx context.Context, slug string, upd SegmentUpdate) (*segment.Segment, error)
+	GetSegmentBySlug(ctx context.Context, slug string) (*segment.Segment, error)
+	// GetSegments returns a page of segments matching the filter and the total number of matching segments.
+	GetSegments(ctx context.Context, filter SegmentFilter) ([]*segment.Segment, int64, error)
+	DeleteSegmentBySlug(ctx context.Context, slug string) error
+
+	// GetSegmentMembers returns a page of segment members ordered by user id.
+	GetSegmentMembers(ctx context.Context, slug string, filter MemberFilter) ([]*segment.Member, error)
+	GetSegmentStats(ctx context.Context, slug string) (*segment.Stats, error)
+
+	// AddSegmentUsers and RemoveSegmentUsers change memberships of many users in batches,
+	// every batch is committed separately. Users which can not be changed are reported in the result.
+	AddSegmentUsers(ctx context.Context, slug string, members []BulkMember) (*BulkResult, error)
+	RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*BulkResult, error)
+
+	// BackfillSegmentPercent enrolls users with ids after afterUserID into the percentage segment,
+	// scanning at most limit users ordered by id.
+	BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (*BackfillPage, error)
+
+	// GetUserSegments returns the segments the user is a member of and the segments whose rule
+	// matches the user's attributes, ordered by id.
+	GetUserSegments(ctx context.Context, userID int64) ([]*segment.Segment, error)
+	// GetUserSegmentsAt returns slugs of the segments the user had at the time, reconstructed from the history.
+	GetUserSegmentsAt(ctx context.Context, userID int64, at time.Time) ([]string, error)
+	ConfigureUserSegments(ctx context.Context, userID int64, segAdd []SegmentToAdd, segDel []string, lenient bool) (*ConfigureResult, error)
+	// SetUserSegments makes segments the exact set of the user's explicit (manual and bulk) memberships: missing
+	// ones are added, other explicit ones removed and delete_at of the remaining ones updated. Listed memberships
+	// become manual. Memberships added automatically by percentage segments are kept unless listed.
+	// Unknown segments are handled as in ConfigureUserSegments.
+	SetUserSegments(ctx context.Context, userID int64, segments []SegmentToAdd, lenient bool) (*ConfigureResult, error)
+	DeleteSegmentsTTL(ctx context.Context) (int64, error)
+
+	GetUserHistory(ctx context.Context, userID int64, from, to time.Time) ([]*history.Record, error)
+
+	// SaveAPIKey stores an API key by the hash of its secret.
+	SaveAPIKey(ctx context.Context, name, role, hash string) (*apikey.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (*apikey.APIKey, error)
+	GetAPIKeys(ctx context.Context) ([]*apikey.APIKey, error)
+	// RevokeAPIKey revokes an active API key, revoked keys are kept for audit.
+	RevokeAPIKey(ctx context.Context, id int64) error
+
+	EnqueueJob(ctx context.Context, typ string, payload []byte) (*job.Job, error)
+	GetJob(ctx context.Context, id int64) (*job.Job, error)
+	// ClaimJob leases the oldest queued job, or a running job whose lease expired, to the caller.
+	// Jobs whose lease expired maxAttempts times are failed. It returns nil if there are no jobs.
+	ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (*job.Job, error)
+	// UpdateJobProgress saves the job progress and partial result and extends its lease. UpdateJobProgress, FinishJob
+	// and ReleaseJob return ErrJobNotFound if the job was taken over by another worker.
+	UpdateJobProgress(ctx context.Context, j *job.Job, lease time.Duration) error
+	// FinishJob saves the job result, the job fails if its Error is set.
+	FinishJob(ctx context.Context, j *job.Job) error
+	// ReleaseJob puts an unfinished job back to the queue, e.g. on shutdown.
+	ReleaseJob(ctx context.Context, j *job.Job) error
+
+	// ClaimIdempotencyKey stores the record of a new request, it expires after lockTimeout unless completed.
+	// If the key is stored already, the stored record is returned with ErrIdempotencyKeyExists.
+	ClaimIdempotencyKey(ctx context.Context, rec *idempotency.Record, lockTimeout time.Duration) (*idempotency.Record, error)
+	// DeleteExpiredIdempotencyKeys removes expired records and returns their number.
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+	// CompleteIdempotencyKey saves the response of the request, it is kept for ttl.
+	CompleteIdempotencyKey(ctx context.Context, rec *idempotency.Record, ttl time.Duration) error
+	// DeleteIdempotencyKey forgets the key, e.g. when the request failed and may be retried.
+	DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string) error
+
+	SaveWebhook(ctx context.Context, url, secret string) (*webhook.Webhook, error)
+	// GetWebhooks returns webhooks with their delivery counts, without secrets.
+	GetWebhooks(ctx context.Context) ([]*webhook.Webhook, error)
+	DeleteWebhook(ctx context.Context, id int64) error
+	// FanOutOutboxEvents moves up to limit outbox events to deliveries of every webhook
+	// and returns the number of moved events. Events are dropped if there are no webhooks.
+	FanOutOutboxEvents(ctx context.Context, limit int) (int, error)
+	// ClaimWebhookDeliveries locks up to limit pending deliveries due for an attempt for lease
+	// and counts the attempt.
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*webhook.Delivery, error)
+	// FinishWebhookDelivery saves the outcome of an attempt and unlocks the delivery.
+	// Delivered deliveries are deleted.
+	FinishWebhookDelivery(ctx context.Context, d *webhook.Delivery) error
+
+	// SaveExperiment stores the experiment and fills its ID and creation time.
+	// It returns ErrSegmentNotFound if the segment of the experiment does not exist.
+	SaveExperiment(ctx context.Context, exp *experiment.Experiment) error
+	GetExperiments(ctx context.Context) ([]*experiment.Experiment, error)
+	DeleteExperiment(ctx context.Context, slug string) error
+
+	// Ping checks the storage is reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// SegmentUpdate is a partial update of segment metadata, nil fields are left unchanged.
+// An empty non-nil Tags clears the tags, an empty Rule makes the segment static.
+type SegmentUpdate struct {
+	Description *string
+	Owner       *string
+	Tags        []string
+	Status      *string
+	Rule        *segment.Rule
+}
+
+// Segment sort orders, segments with equal sort values are ordered by id.
+const (
+	SortSegmentsByID        = "id"
+	SortSegmentsBySlug      = "slug"
+	SortSegmentsByCreatedAt = "created_at"
+	SortSegmentsByUpdatedAt = "updated_at"
+)
+
+// SegmentFilter selects a page of segments. Empty fields do not filter.
+type SegmentFilter struct {
+	// Query is a case-insensitive slug substring.
+	Query  string
+	Prefix string
+	// Tags are required to be all present on the segment.
+	Tags   []string
+	Owner  string
+	Status string
+
+	Sort string
+	Desc bool
+	// After is the cursor of the last segment of the previous page.
+	After *SegmentCursor
+	Limit int
+}
+
+// SegmentCursor is the position of a segment in a sort order: its sort value and id.
+type SegmentCursor struct {
+	Value string `json:"v,omitempty"`
+	ID    int64  `json:"id"`
+}
+
+// NewSegmentCursor returns the cursor of seg in the sort order.
+func NewSegmentCursor(seg *segment.Segment, sort string) *SegmentCursor {
+	c := &SegmentCursor{ID: seg.ID}
+
+	switch sort {
+	case SortSegmentsBySlug:
+		c.Value = seg.Slug
+	case SortSegmentsByCreatedAt:
+		c.Value = seg.CreatedAt.Format(time.RFC3339Nano)
+	case SortSegmentsByUpdatedAt:
+		c.Value = seg.UpdatedAt.Format(time.RFC3339Nano)
+	}
+
+	return c
+}
+
+// MemberFilter selects a page of segment members.
+type MemberFilter struct {
+	// AfterUserID is the last user id of the previous page.
+	AfterUserID int64
+	// ExpiringBefore, if set, keeps only members removed by TTL before that time.
+	ExpiringBefore *time.Time
+	Limit          int
+}
+
+// BulkMember is a user to add to a segment. If DeleteAt is set,
+// the user is removed from the segment at that time.
+type BulkMember struct {
+	UserID   int64
+	DeleteAt *time.Time
+}
+
+// BulkResult describes the outcome of a bulk membership change.
+type BulkResult struct {
+	// Changed is the number of users added or removed.
+	Changed int64
+	Failed  []BulkFailure
+}
+
+type BulkFailure struct {
+	UserID int64  `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+func (r *BulkResult) Fail(userID int64, reason string) {
+	r.Failed = append(r.Failed, BulkFailure{UserID: userID, Reason: reason})
+}
+
+// BackfillPage describes a page of users scanned by BackfillSegmentPercent.
+type BackfillPage struct {
+	// LastUserID is the id of the last scanned user, the next page starts after it.
+	LastUserID int64
+	// Scanned is the number of scanned users, 0 when there are no more users.
+	Scanned  int
+	Enrolled int64
+}
+
+// SegmentToAdd is a segment to add to a user. If DeleteAt is set,
+// the user is removed from the segment at that time.
+type SegmentToAdd struct {
+	Slug     string
+	DeleteAt *time.Time
+}
+
+// ConfigureResult describes the outcome of configuring user segments.
+type ConfigureResult struct {
+	Added   []string
+	Removed []string
+	// Updated lists segments whose delete_at was changed by SetUserSegments.
+	Updated  []string
+	Rejected []RejectedSegment
+	// Ignored lists unknown segments skipped in lenient mode.
+	Ignored []string
+}
+
+// RejectedSegment is a segment which could not be added to or deleted from a user.
+type RejectedSegment struct {
+	Slug   string
+	Reason string
+}
+
+func (r *ConfigureResult) Reject(slug, reason string) {
+	r.Rejected = append(r.Rejected, RejectedSegment{Slug: slug, Reason: reason})
+}
+
+// Unknown returns slugs rejected because the segment does not exist.
+func (r *ConfigureResult) Unknown() []string {
+	var unknown []string
+	for _, rej := range r.Rejected {
+		if rej.Reason == RejectReasonNotFound {
+			unknown = append(unknown, rej.Slug)
+		}
+	}
+
+	return unknown
+}
@@ -0,0 +1,280 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"avito-test-task-2023/internal/config"
+	"avito-test-task-2023/internal/lib/logger/sl"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/storage"
+)
+
+type Queue interface {
+	ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (*job.Job, error)
+	UpdateJobProgress(ctx context.Context, j *job.Job, lease time.Duration) error
+	FinishJob(ctx context.Context, j *job.Job) error
+	ReleaseJob(ctx context.Context, j *job.Job) error
+}
+
+// Handler runs a job of some type and returns its result. The job fails if Handler returns an error,
+// only the message of a Failure is shown to the user. Handlers should save their progress with
+// Task.Checkpoint: a job interrupted by a shutdown or a crash is run again and may Task.Resume from it.
+type Handler func(ctx context.Context, t *Task) (any, error)
+
+// Failure is a job error whose message is shown to the user as is.
+type Failure string
+
+func (f Failure) Error() string {
+	return string(f)
+}
+
+// Runner runs queued jobs in a pool of workers.
+type Runner struct {
+	log          *slog.Logger
+	queue        Queue
+	handlers     map[string]Handler
+	workers      int
+	pollInterval time.Duration
+	lease        time.Duration
+	maxAttempts  int
+}
+
+func NewRunner(log *slog.Logger, queue Queue, cfg config.Jobs) *Runner {
+	return &Runner{
+		log: log.With(
+			slog.String("component", "worker"),
+		),
+		queue:        queue,
+		handlers:     make(map[string]Handler),
+		workers:      cfg.Workers,
+		pollInterval: cfg.PollInterval,
+		lease:        cfg.Lease,
+		maxAttempts:  cfg.MaxAttempts,
+	}
+}
+
+// Register sets the handler of jobs of the type. It must be called before Run.
+func (r *Runner) Register(typ string, h Handler) {
+	r.handlers[typ] = h
+}
+
+// Run runs jobs until ctx is done. Jobs still running then are put back to the queue.
+func (r *Runner) Run(ctx context.Context) {
+	r.log.Info("job runner started", slog.Int("workers", r.workers))
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	r.log.Info("job runner stopped")
+}
+
+func (r *Runner) work(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		j, err := r.queue.ClaimJob(ctx, r.lease, r.maxAttempts)
+		if err != nil && ctx.Err() == nil {
+			r.log.Error("failed to claim job", sl.Err(err))
+		}
+
+		if j != nil {
+			r.run(ctx, j)
+			// look for the next job right away
+			timer.Reset(0)
+			continue
+		}
+
+		timer.Reset(r.pollInterval)
+	}
+}
+
+func (r *Runner) run(ctx context.Context, j *job.Job) {
+	log := r.log.With(
+		slog.Int64("job_id", j.ID),
+		slog.String("type", j.Type),
+		slog.Int("attempt", j.Attempts),
+	)
+
+	handler, ok := r.handlers[j.Type]
+	if !ok {
+		log.Error("unknown job type")
+
+		j.Error = "unknown job type"
+		r.finish(log, j)
+		return
+	}
+
+	log.Info("job started")
+
+	t := &Task{job: j, progress: j.Progress, result: j.Result}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	heartbeatDone := make(chan struct{})
+	var lost bool
+	go func() {
+		defer close(heartbeatDone)
+		lost = r.heartbeat(jobCtx, log, t)
+		if lost {
+			cancel()
+		}
+	}()
+
+	result, err := handler(jobCtx, t)
+
+	cancel()
+	<-heartbeatDone
+
+	t.snapshot(j)
+
+	switch {
+	case lost:
+		log.Warn("job lease lost, the job is left to another worker")
+		return
+	case err != nil && ctx.Err() != nil:
+		// the service is stopping, the job continues after the restart
+		if err := r.queue.ReleaseJob(context.Background(), j); err != nil {
+			log.Error("failed to release job", sl.Err(err))
+			return
+		}
+
+		log.Info("job released", slog.Int64("done", j.Progress.Done))
+		return
+	case err != nil:
+		var failure Failure
+		if errors.As(err, &failure) {
+			j.Error = failure.Error()
+		} else {
+			j.Error = "internal error"
+		}
+
+		log.Error("job failed", sl.Err(err))
+	default:
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Error("failed to encode job result", sl.Err(err))
+
+			j.Error = "internal error"
+		} else {
+			j.Result = data
+		}
+	}
+
+	r.finish(log, j)
+}
+
+func (r *Runner) finish(log *slog.Logger, j *job.Job) {
+	// the job is done, so it is saved even if the service is stopping
+	if err := r.queue.FinishJob(context.Background(), j); err != nil {
+		log.Error("failed to finish job", sl.Err(err))
+		return
+	}
+
+	log.Info("job finished", slog.String("status", j.Status))
+}
+
+// heartbeat saves the task progress and extends the job lease until ctx is done.
+// It returns true if the job was taken over by another worker.
+func (r *Runner) heartbeat(ctx context.Context, log *slog.Logger, t *Task) bool {
+	ticker := time.NewTicker(r.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		j := &job.Job{ID: t.job.ID, Attempts: t.job.Attempts}
+		t.snapshot(j)
+
+		err := r.queue.UpdateJobProgress(ctx, j, r.lease)
+		if errors.Is(err, storage.ErrJobNotFound) {
+			return true
+		}
+		if err != nil && ctx.Err() == nil {
+			// the lease is extended by the next heartbeat if the storage recovers in time
+			log.Error("failed to update job progress", sl.Err(err))
+		}
+	}
+}
+
+// Task is a job being run by a Handler.
+type Task struct {
+	job *job.Job
+
+	mu       sync.Mutex
+	progress job.Progress
+	result   json.RawMessage
+}
+
+// Payload decodes the job payload into v.
+func (t *Task) Payload(v any) error {
+	if err := json.Unmarshal(t.job.Payload, v); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	return nil
+}
+
+// Resume decodes the partial result saved by the previous attempt of the job into v and
+// returns the progress saved with it. The progress is zero if there was no checkpoint.
+func (t *Task) Resume(v any) (job.Progress, error) {
+	if len(t.job.Result) == 0 {
+		return job.Progress{}, nil
+	}
+
+	if err := json.Unmarshal(t.job.Result, v); err != nil {
+		return job.Progress{}, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+
+	return t.job.Progress, nil
+}
+
+// Checkpoint records the progress and the partial result of the job. They are saved
+// periodically, so that the user sees the progress and the job can resume from it.
+func (t *Task) Checkpoint(done, total int64, result any) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.progress = job.Progress{Done: done, Total: total}
+	t.result = data
+
+	return nil
+}
+
+// snapshot copies the recorded progress and partial result to j.
+func (t *Task) snapshot(j *job.Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	j.Progress = t.progress
+	j.Result = t.result
+}
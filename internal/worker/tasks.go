@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"avito-test-task-2023/internal/lib/report"
+	"avito-test-task-2023/internal/models/history"
+	"avito-test-task-2023/internal/models/job"
+	"avito-test-task-2023/internal/models/user"
+	"avito-test-task-2023/internal/storage"
+)
+
+// chunkSize is the number of users processed between checkpoints.
+const chunkSize = 1000
+
+var errSegmentNotFound = Failure("segment not found")
+
+type BulkEnrollResult struct {
+	Added  int64                 `json:"added"`
+	Failed []storage.BulkFailure `json:"failed,omitempty"`
+}
+
+type SegmentUsersAdder interface {
+	AddSegmentUsers(ctx context.Context, slug string, members []storage.BulkMember) (*storage.BulkResult, error)
+}
+
+// NewBulkEnroll returns the handler of job.TypeBulkEnroll jobs, which add users to a segment.
+func NewBulkEnroll(usersAdder SegmentUsersAdder) Handler {
+	return func(ctx context.Context, t *Task) (any, error) {
+		var payload job.BulkEnrollPayload
+		if err := t.Payload(&payload); err != nil {
+			return nil, err
+		}
+
+		var result BulkEnrollResult
+		progress, err := t.Resume(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		total := int64(len(payload.Users))
+		for done := progress.Done; done < total; {
+			users := payload.Users[done:]
+			if len(users) > chunkSize {
+				users = users[:chunkSize]
+			}
+
+			chunk := make([]storage.BulkMember, len(users))
+			for i, usr := range users {
+				chunk[i] = storage.BulkMember{UserID: usr.UserID, DeleteAt: usr.DeleteAt}
+			}
+
+			res, err := usersAdder.AddSegmentUsers(ctx, payload.Slug, chunk)
+			if errors.Is(err, storage.ErrSegmentNotFound) {
+				return nil, errSegmentNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			result.Added += res.Changed
+			result.Failed = append(result.Failed, res.Failed...)
+			done += int64(len(chunk))
+
+			if err := t.Checkpoint(done, total, result); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	}
+}
+
+type BulkRemoveResult struct {
+	Removed int64                 `json:"removed"`
+	Failed  []storage.BulkFailure `json:"failed,omitempty"`
+}
+
+type SegmentUsersRemover interface {
+	RemoveSegmentUsers(ctx context.Context, slug string, userIDs []int64) (*storage.BulkResult, error)
+}
+
+// NewBulkRemove returns the handler of job.TypeBulkRemove jobs, which remove users from a segment.
+func NewBulkRemove(usersRemover SegmentUsersRemover) Handler {
+	return func(ctx context.Context, t *Task) (any, error) {
+		var payload job.BulkRemovePayload
+		if err := t.Payload(&payload); err != nil {
+			return nil, err
+		}
+
+		var result BulkRemoveResult
+		progress, err := t.Resume(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		total := int64(len(payload.UserIDs))
+		for done := progress.Done; done < total; {
+			chunk := payload.UserIDs[done:]
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+
+			res, err := usersRemover.RemoveSegmentUsers(ctx, payload.Slug, chunk)
+			if errors.Is(err, storage.ErrSegmentNotFound) {
+				return nil, errSegmentNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			result.Removed += res.Changed
+			result.Failed = append(result.Failed, res.Failed...)
+			done += int64(len(chunk))
+
+			if err := t.Checkpoint(done, total, result); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	}
+}
+
+type PercentBackfillResult struct {
+	Enrolled int64 `json:"enrolled"`
+	// LastUserID is the last scanned user, the backfill continues after it.
+	LastUserID int64 `json:"last_user_id"`
+}
+
+type PercentBackfiller interface {
+	BackfillSegmentPercent(ctx context.Context, slug string, afterUserID int64, limit int) (*storage.BackfillPage, error)
+}
+
+type UsersCounter interface {
+	GetUsers(ctx context.Context, limit, offset int, name string) ([]*user.User, int64, error)
+}
+
+// NewPercentBackfill returns the handler of job.TypePercentBackfill jobs, which enroll existing
+// users into a percentage segment. Users created meanwhile are enrolled on creation.
+func NewPercentBackfill(backfiller PercentBackfiller, counter UsersCounter) Handler {
+	return func(ctx context.Context, t *Task) (any, error) {
+		var payload job.PercentBackfillPayload
+		if err := t.Payload(&payload); err != nil {
+			return nil, err
+		}
+
+		var result PercentBackfillResult
+		progress, err := t.Resume(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		// the total is an estimate, users may be created and deleted during the backfill
+		_, total, err := counter.GetUsers(ctx, 1, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for done := progress.Done; ; {
+			page, err := backfiller.BackfillSegmentPercent(ctx, payload.Slug, result.LastUserID, chunkSize)
+			if errors.Is(err, storage.ErrSegmentNotFound) {
+				return nil, errSegmentNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if page.Scanned == 0 {
+				return result, nil
+			}
+
+			result.Enrolled += page.Enrolled
+			result.LastUserID = page.LastUserID
+			done += int64(page.Scanned)
+			if done > total {
+				total = done
+			}
+
+			if err := t.Checkpoint(done, total, result); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+type HistoryReportResult struct {
+	Link    string `json:"link"`
+	Records int    `json:"records"`
+}
+
+type UserHistoryGetter interface {
+	GetUserHistory(ctx context.Context, userID int64, from, to time.Time) ([]*history.Record, error)
+}
+
+// NewHistoryReport returns the handler of job.TypeHistoryReport jobs, which generate
+// a user history report for a month.
+func NewHistoryReport(historyGetter UserHistoryGetter, reportsDir string) Handler {
+	return func(ctx context.Context, t *Task) (any, error) {
+		var payload job.HistoryReportPayload
+		if err := t.Payload(&payload); err != nil {
+			return nil, err
+		}
+
+		from, err := time.Parse(report.PeriodLayout, payload.Period)
+		if err != nil {
+			return nil, Failure("invalid period")
+		}
+
+		records, err := historyGetter.GetUserHistory(ctx, payload.UserID, from, from.AddDate(0, 1, 0))
+		if err != nil {
+			return nil, err
+		}
+
+		name := report.HistoryFileName(payload.UserID, payload.Period)
+		if err := report.WriteHistoryCSV(reportsDir, name, records); err != nil {
+			return nil, err
+		}
+
+		return HistoryReportResult{Link: payload.Link, Records: len(records)}, nil
+	}
+}